@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kohkimakimoto/crun/crun"
+	"os"
+)
+
+const configUsage = `Usage: crun [OPTIONS...] config show [--origin] [-c <path>]
+       crun [OPTIONS...] config check [-c <path>]
+
+Subcommands:
+  show     Print the effective settings. '--origin' shows where each value came from.
+  check    Validate the config strictly. It exits with 1 if any problems are found.`
+
+// configCommand is 'crun config <SUBCOMMAND>'.
+type configCommand struct {
+	name   string
+	origin bool
+}
+
+// parseConfigCommand parses the arguments after 'config'. '-c' option can be also specified after the subcommand.
+func parseConfigCommand(args []string, optConfigFile *string) (*configCommand, error) {
+	if len(args) == 0 {
+		return nil, errors.New(configUsage)
+	}
+
+	cmd := &configCommand{name: args[0]}
+	fs := flag.NewFlagSet("config "+cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, configUsage)
+	}
+	fs.StringVar(optConfigFile, "c", *optConfigFile, "")
+	fs.StringVar(optConfigFile, "config-file", *optConfigFile, "")
+
+	switch cmd.name {
+	case "show":
+		fs.BoolVar(&cmd.origin, "origin", false, "")
+	case "check":
+	default:
+		return nil, fmt.Errorf("unknown config subcommand '%s'\n\n%s", cmd.name, configUsage)
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// run runs the subcommand with the loaded config.
+func (cmd *configCommand) run(c *crun.Crun) int {
+	switch cmd.name {
+	case "show":
+		if err := c.Config.Show(os.Stdout, cmd.origin); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "check":
+		problems := c.Config.Check()
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+			return 1
+		}
+		fmt.Println("config is valid")
+	}
+	return 0
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/Songmu/wrapcommander"
 	"github.com/kohkimakimoto/crun/crun"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func main() {
@@ -31,11 +34,17 @@ func realMain() (status int) {
 	}()
 
 	// parse flags...
-	var optVersion, optQuiet, optLua, optWithoutOverlapping, optNoConfig bool
-	var optTag, optWd, optLogFile, optLogPrefix, optConfigFile, optMutexdir, optMutex, optUser, optGroup string
-	var optTimeout int64
-	var optEnv, optPre, optNotice, optSuccess, optFailure, optPost stringSlice
+	var optVersion, optQuiet, optLua, optLuaSandbox, optLuaHandler, optWithoutOverlapping, optNoConfig bool
+	var optTag, optWd, optLogFile, optLogPrefix, optConfigFile, optMutexdir, optMutex, optUser, optGroup, optHandlerUser, optHandlerGroup, optHandlerFailure, optLogFileMode, optLogFileOwner, optPingURL, optMetricsTextfileDir, optMetricsType, optMetricsAddress, optTracingEndpoint, optJob, optLuaReport string
+	var optTimeout, optHandlerTimeout, optHeartbeatInterval crun.Duration
+	var optHandlerRetries, optMaxParallelHandlers int
+	var optExecShim, optCgroupParent, optCgroupMemoryMax, optCgroupCpuMax, optIoniceClass, optCpuAffinity string
+	var optCgroupPidsMax, optCgroupIoWeight int64
+	var optNice, optIoniceLevel int
+	var optEnv, optPre, optNotice, optSuccess, optFailure, optPost, optHeartbeat, optLimit, optHandlerMode stringSlice
 
+	flag.StringVar(&optJob, "j", "", "")
+	flag.StringVar(&optJob, "job", "", "")
 	flag.StringVar(&optTag, "t", "", "")
 	flag.StringVar(&optTag, "tag", "", "")
 	flag.StringVar(&optWd, "w", "", "")
@@ -48,6 +57,15 @@ func realMain() (status int) {
 	flag.StringVar(&optMutex, "mutex", "", "")
 	flag.StringVar(&optUser, "user", "", "")
 	flag.StringVar(&optGroup, "group", "", "")
+	flag.StringVar(&optHandlerUser, "handler-user", "", "")
+	flag.StringVar(&optHandlerGroup, "handler-group", "", "")
+	flag.Var(&optHandlerTimeout, "handler-timeout", "")
+	flag.IntVar(&optHandlerRetries, "handler-retries", 0, "")
+	flag.StringVar(&optHandlerFailure, "handler-failure", "", "")
+	flag.Var(&optHandlerMode, "handler-mode", "")
+	flag.IntVar(&optMaxParallelHandlers, "max-parallel-handlers", 0, "")
+	flag.StringVar(&optLogFileMode, "log-file-mode", "", "")
+	flag.StringVar(&optLogFileOwner, "log-file-owner", "", "")
 	flag.Var(&optEnv, "e", "")
 	flag.Var(&optEnv, "env", "")
 	flag.BoolVar(&optVersion, "v", false, "")
@@ -57,17 +75,40 @@ func realMain() (status int) {
 	flag.BoolVar(&optNoConfig, "n", false, "")
 	flag.BoolVar(&optNoConfig, "no-config", false, "")
 	flag.BoolVar(&optWithoutOverlapping, "without-overlapping", false, "")
-	flag.Int64Var(&optTimeout, "timeout", 0, "")
+	flag.Var(&optTimeout, "timeout", "")
+	flag.StringVar(&optPingURL, "ping-url", "", "")
+	flag.StringVar(&optMetricsTextfileDir, "metrics-textfile-dir", "", "")
+	flag.StringVar(&optMetricsType, "metrics-type", "", "")
+	flag.StringVar(&optMetricsAddress, "metrics-address", "", "")
+	flag.StringVar(&optTracingEndpoint, "tracing-endpoint", "", "")
 	flag.Var(&optPre, "pre", "")
 	flag.Var(&optNotice, "notice", "")
 	flag.Var(&optSuccess, "success", "")
 	flag.Var(&optFailure, "failure", "")
 	flag.Var(&optPost, "post", "")
+	flag.Var(&optHeartbeat, "heartbeat", "")
+	flag.Var(&optHeartbeatInterval, "heartbeat-interval", "")
+	flag.Var(&optLimit, "limit", "")
+	flag.StringVar(&optCgroupParent, "cgroup-parent", "", "")
+	flag.StringVar(&optCgroupMemoryMax, "cgroup-memory-max", "", "")
+	flag.StringVar(&optCgroupCpuMax, "cgroup-cpu-max", "", "")
+	flag.Int64Var(&optCgroupPidsMax, "cgroup-pids-max", 0, "")
+	flag.Int64Var(&optCgroupIoWeight, "cgroup-io-weight", 0, "")
+	flag.IntVar(&optNice, "nice", 0, "")
+	flag.StringVar(&optIoniceClass, "ionice-class", "", "")
+	flag.IntVar(&optIoniceLevel, "ionice-level", -1, "")
+	flag.StringVar(&optCpuAffinity, "cpu-affinity", "", "")
 	// hidden flag
 	flag.BoolVar(&optLua, "lua", false, "")
+	flag.BoolVar(&optLuaSandbox, "lua-sandbox", false, "")
+	flag.StringVar(&optLuaReport, "lua-report", "", "")
+	flag.StringVar(&optExecShim, "exec-shim", "", "")
+	flag.BoolVar(&optLuaHandler, "lua-handler", false, "")
 
 	flag.Usage = func() {
 		fmt.Println(`Usage: ` + crun.Name + ` [OPTIONS...] <COMMAND...>
+       ` + crun.Name + ` run <JOB> [OPTIONS...] [-- <COMMAND...>]
+       ` + crun.Name + ` [OPTIONS...] config <show|check>
 
 ` + crun.Name + ` -- Command execution wrapper.
 version ` + crun.Version + ` (` + crun.CommitHash + `)
@@ -77,8 +118,9 @@ The MIT License (MIT)
 
 Options:
   (General)
-  -c, --config-file <path>         Load config from the file.
+  -c, --config-file <path>         Load config from the file. A file with '.lua' extension is a Lua config file.
   -n, --no-config                  No config file will be used
+  -j, --job <name>                 Run the job that is defined by '[jobs.<name>]' table in the config file.
   -t, --tag <string>               Set a tag of the job.
   -w, --working-directory <dir>    If specified, use the given directory as working directory.
   -e, --env <KEY=VALUE>            Set custom environment variables. ex) -e KEY=VALUE
@@ -91,10 +133,23 @@ Options:
   --success <handler>              Set a success handler. This option can be set multi time.
   --failure <handler>              Set a failure handler. This option can be set multi time.
   --post <handler>                 Set a post handler. This option can be set multi time.
+  --heartbeat <handler>            Set a heartbeat handler. This option can be set multi time.
+  --heartbeat-interval <duration>  The interval to run heartbeat handlers while the command runs. The unit is second, or a duration like '5m'.
+  --handler-user <user>            Set an execution user of the handlers. (default: the execution user)
+  --handler-group <group>          Set an execution group of the handlers. (default: the execution group)
+  --handler-timeout <duration>     A handler is terminated when the timeout elapses. The unit is second, or a duration like '30s'.
+  --handler-retries <number>       The number of retries when a handler fails.
+  --handler-failure <policy>       The policy when a handler fails: 'ignore', 'warn' or 'fail_job'.
+                                   (default: 'fail_job' for pre handlers and 'warn' for the others)
+  --handler-mode <TYPE=MODE>       Set how to run the handlers of the hook type: 'parallel' or 'sequential'.
+                                   ex) --handler-mode post=sequential (default: parallel)
+  --max-parallel-handlers <number> The maximum number of the handlers that run at once.
 
   (Logging)
   --log-file <path>                The file path to write merged output. The strftime format like '%Y%m%d.log' is available.
   --log-prefix <string>            The prefix for the merged output log. This option is used with '--log-file' option.
+  --log-file-mode <mode>           The file mode of the created log file. (default: 0644)
+  --log-file-owner <user:group>    The owner of the created log file.
   -q, --quiet                      Suppress outputting to stdout.
 
   (Overlapping)
@@ -103,7 +158,29 @@ Options:
   --mutex <string>                 Overriding the mutex id.
 
   (Timeout)
-  --timeout <number>               The command is terminated when the timeout elapses. The unit is second.
+  --timeout <duration>             The command is terminated when the timeout elapses. The unit is second, or a duration like '1h30m'.
+
+  (Monitoring)
+  --ping-url <url>                 The URL of a healthchecks-style monitor. Crun pings '<url>/start', '<url>' or '<url>/fail'.
+  --metrics-textfile-dir <dir>     The directory to write the metrics of the job for the node_exporter textfile collector.
+  --metrics-type <type>            Push the metrics of the job at the end of the job: 'pushgateway' or 'statsd'.
+  --metrics-address <address>      The URL of the Pushgateway or the 'host:port' of the StatsD server.
+  --tracing-endpoint <url>         Export the trace of the job to the OpenTelemetry collector with OTLP/HTTP. ex) http://localhost:4318
+
+  (Resource Limits)
+  --limit <NAME=VALUE>             Set a resource limit of the command. This option can be set multi time.
+                                   NAME: nofile, nproc, as, cpu, fsize or core. VALUE: number or 'unlimited'.
+  --cgroup-parent <path>           The parent cgroup v2 directory. (default: /sys/fs/cgroup/crun.slice)
+  --cgroup-memory-max <value>      Set 'memory.max' of the cgroup for the command. ex) 512M
+  --cgroup-cpu-max <value>         Set 'cpu.max' of the cgroup for the command. ex) '50000 100000'
+  --cgroup-pids-max <number>       Set 'pids.max' of the cgroup for the command.
+  --cgroup-io-weight <number>      Set 'io.weight' of the cgroup for the command. (1-10000)
+
+  (Scheduling)
+  --nice <number>                  Set the nice value of the command. (-20-19)
+  --ionice-class <class>           Set the IO scheduling class of the command. (realtime, best-effort or idle)
+  --ionice-level <number>          Set the IO scheduling priority in the class. (0-7, default: 4)
+  --cpu-affinity <cpus>            Set the CPUs that the command runs on by comma-separated values. ex) 0,1
 
   (Help)
   -h, --help                       Show help.
@@ -112,6 +189,24 @@ Options:
 	}
 	flag.Parse()
 
+	// 'crun run <JOB> [OPTIONS...]' is the same as 'crun --job <JOB> [OPTIONS...]'.
+	if isSubcommand("run") && flag.NArg() >= 2 && optJob == "" {
+		optJob = flag.Arg(1)
+		flag.CommandLine.Parse(flag.Args()[2:])
+	}
+
+	var configCmd *configCommand
+	if isSubcommand("config") {
+		cmd, err := parseConfigCommand(flag.Args()[1:], &optConfigFile)
+		if err == flag.ErrHelp {
+			return 0
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		configCmd = cmd
+	}
+
 	if optVersion {
 		// show version
 		fmt.Println(crun.Name + " version " + crun.Version + " (" + crun.CommitHash + ")")
@@ -123,14 +218,46 @@ Options:
 		return 0
 	}
 
-	if optLua {
-		// run lua mode for extension script.
-		if flag.NArg() == 0 {
-			flag.Usage()
-			return 0
+	if optExecShim != "" {
+		// run the command with process attributes that are set by crun itself.
+		if err := crun.RunExecShim(optExecShim, flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 127
+		}
+
+		return 0
+	}
+
+	if optLuaHandler {
+		// run a Lua handler for the parent crun process.
+		if err := crun.RunLuaHandler(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
 		}
 
+		return 0
+	}
+
+	if optLua {
+		// run lua mode for extension script.
+		// '-e' is the code to run in this mode. Without the code and the script, it starts the REPL.
 		lapp := crun.NewLuaApp()
+		if optLuaSandbox {
+			lapp.Sandbox = crun.NewLuaSandbox()
+		}
+		// handlers run by crun have the sandbox settings of the config, and the script can not disable it.
+		if sandbox, err := crun.LuaSandboxFromEnv(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v", err)
+			return 1
+		} else if sandbox != nil {
+			lapp.Sandbox = sandbox
+		}
+		lapp.Path = os.Getenv(crun.LuaPathEnv)
+		lapp.Chunks = optEnv
+		lapp.Report = optLuaReport
+		if home, err := os.UserHomeDir(); err == nil {
+			lapp.HistoryFile = filepath.Join(home, ".crun_lua_history")
+		}
 		if err := lapp.Run(flag.Args()); err != nil {
 			fmt.Fprintf(os.Stderr, "%v", err)
 			return 1
@@ -149,7 +276,22 @@ Options:
 		}
 	}
 
+	if optJob != "" {
+		if err := c.Config.ApplyJob(optJob); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if err := c.Config.ApplyEnv(os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
 	c.CommandArgs = flag.Args()
+	if len(c.CommandArgs) == 0 {
+		c.CommandArgs = c.Config.Command
+	}
 	if optTag != "" {
 		c.Config.Tag = optTag
 	}
@@ -171,12 +313,24 @@ Options:
 	if len(optPost) > 0 {
 		c.Config.PostHandlers = append(c.Config.PostHandlers, optPost...)
 	}
+	if len(optHeartbeat) > 0 {
+		c.Config.HeartbeatHandlers = append(c.Config.HeartbeatHandlers, optHeartbeat...)
+	}
+	if optHeartbeatInterval > 0 {
+		c.Config.HeartbeatInterval = optHeartbeatInterval
+	}
 	if optLogFile != "" {
 		c.Config.LogFile = optLogFile
 	}
 	if optLogPrefix != "" {
 		c.Config.LogPrefix = optLogPrefix
 	}
+	if optLogFileMode != "" {
+		c.Config.LogFileMode = optLogFileMode
+	}
+	if optLogFileOwner != "" {
+		c.Config.LogFileOwner = optLogFileOwner
+	}
 	if optQuiet {
 		c.Config.Quiet = optQuiet
 	}
@@ -195,12 +349,97 @@ Options:
 	if optGroup != "" {
 		c.Config.Group = optGroup
 	}
+	if optHandlerUser != "" {
+		c.Config.HandlerUser = optHandlerUser
+	}
+	if optHandlerGroup != "" {
+		c.Config.HandlerGroup = optHandlerGroup
+	}
+	if optHandlerTimeout > 0 {
+		c.Config.HandlerTimeout = optHandlerTimeout
+	}
+	if optHandlerRetries > 0 {
+		c.Config.HandlerRetries = optHandlerRetries
+	}
+	if optHandlerFailure != "" {
+		c.Config.HandlerFailure = optHandlerFailure
+	}
+	for _, m := range optHandlerMode {
+		splitString := strings.SplitN(m, "=", 2)
+		if len(splitString) != 2 {
+			fmt.Fprintf(os.Stderr, "invalid handler mode format '%s'. must be 'TYPE=MODE'\n", m)
+			return 1
+		}
+		c.Config.HandlerMode[splitString[0]] = splitString[1]
+	}
+	if optMaxParallelHandlers > 0 {
+		c.Config.MaxParallelHandlers = optMaxParallelHandlers
+	}
 	if len(optEnv) > 0 {
 		c.Config.Environment = append(c.Config.Environment, optEnv...)
 	}
 	if optTimeout > 0 {
 		c.Config.Timeout = optTimeout
 	}
+	if optPingURL != "" {
+		c.Config.PingURL = optPingURL
+	}
+	if optMetricsTextfileDir != "" {
+		c.Config.MetricsTextfileDir = optMetricsTextfileDir
+	}
+	if optMetricsType != "" {
+		c.Config.Metrics.Type = optMetricsType
+	}
+	if optMetricsAddress != "" {
+		c.Config.Metrics.Address = optMetricsAddress
+	}
+	if optTracingEndpoint != "" {
+		c.Config.Tracing.Endpoint = optTracingEndpoint
+	}
+	if optCgroupParent != "" {
+		c.Config.Cgroup.Parent = optCgroupParent
+	}
+	if optCgroupMemoryMax != "" {
+		c.Config.Cgroup.MemoryMax = optCgroupMemoryMax
+	}
+	if optCgroupCpuMax != "" {
+		c.Config.Cgroup.CpuMax = optCgroupCpuMax
+	}
+	if optCgroupPidsMax > 0 {
+		c.Config.Cgroup.PidsMax = optCgroupPidsMax
+	}
+	if optCgroupIoWeight > 0 {
+		c.Config.Cgroup.IoWeight = optCgroupIoWeight
+	}
+	if optNice != 0 {
+		c.Config.Nice = optNice
+	}
+	if optIoniceClass != "" {
+		c.Config.IoniceClass = optIoniceClass
+	}
+	if optIoniceLevel >= 0 {
+		c.Config.IoniceLevel = optIoniceLevel
+	}
+	if optCpuAffinity != "" {
+		cpus, err := parseCpuList(optCpuAffinity)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		c.Config.CpuAffinity = cpus
+	}
+	for _, l := range optLimit {
+		if err := c.Config.Limits.Set(l); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	recordFlagOrigins(c)
+
+	if configCmd != nil {
+		return configCmd.run(c)
+	}
 
 	r, err := c.Run()
 	if err != nil {
@@ -211,12 +450,120 @@ Options:
 	return r.ExitCode
 }
 
+func parseCpuList(s string) ([]int, error) {
+	cpus := []int{}
+	for _, v := range strings.Split(s, ",") {
+		cpu, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list '%s'", s)
+		}
+		cpus = append(cpus, cpu)
+	}
+	return cpus, nil
+}
+
+// loadConfigFile loads the config file that is specified by '-c' option.
+// Without the option, it loads the system, drop-in, user and project config files in this order.
 func loadConfigFile(c *crun.Crun, optConfigFile string) error {
 	if optConfigFile != "" {
 		if err := c.Config.LoadConfigFile(optConfigFile); err != nil {
 			return fmt.Errorf("failed to open file: %s %v", optConfigFile, err)
 		}
+		return nil
+	}
+
+	files, err := crun.ConfigFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := c.Config.LoadConfigFile(file); err != nil {
+			return fmt.Errorf("failed to open file: %s %v", file, err)
+		}
 	}
 
 	return nil
 }
+
+// isSubcommand reports whether the first argument is the subcommand. An argument after '--' is always a command to run.
+func isSubcommand(name string) bool {
+	if flag.NArg() == 0 || flag.Arg(0) != name {
+		return false
+	}
+	return os.Args[len(os.Args)-flag.NArg()-1] != "--"
+}
+
+// flagConfigKeys are the config keys that the options set.
+var flagConfigKeys = map[string]string{
+	"t":                     "tag",
+	"tag":                   "tag",
+	"w":                     "working_directory",
+	"working-directory":     "working_directory",
+	"e":                     "environment",
+	"env":                   "environment",
+	"user":                  "user",
+	"group":                 "group",
+	"pre":                   "pre",
+	"notice":                "notice",
+	"success":               "success",
+	"failure":               "failure",
+	"post":                  "post",
+	"heartbeat":             "heartbeat",
+	"heartbeat-interval":    "heartbeat_interval",
+	"handler-user":          "handler_user",
+	"handler-group":         "handler_group",
+	"handler-timeout":       "handler_timeout",
+	"handler-retries":       "handler_retries",
+	"handler-failure":       "handler_failure",
+	"handler-mode":          "handler_mode",
+	"max-parallel-handlers": "max_parallel_handlers",
+	"log-file":              "log_file",
+	"log-prefix":            "log_prefix",
+	"log-file-mode":         "log_file_mode",
+	"log-file-owner":        "log_file_owner",
+	"q":                     "quiet",
+	"quiet":                 "quiet",
+	"without-overlapping":   "without_overlapping",
+	"mutexdir":              "mutexdir",
+	"mutex":                 "mutex",
+	"timeout":               "timeout",
+	"ping-url":              "ping_url",
+	"metrics-textfile-dir":  "metrics_textfile_dir",
+	"metrics-type":          "metrics.type",
+	"metrics-address":       "metrics.address",
+	"tracing-endpoint":      "tracing.endpoint",
+	"cgroup-parent":         "cgroup.parent",
+	"cgroup-memory-max":     "cgroup.memory_max",
+	"cgroup-cpu-max":        "cgroup.cpu_max",
+	"cgroup-pids-max":       "cgroup.pids_max",
+	"cgroup-io-weight":      "cgroup.io_weight",
+	"nice":                  "nice",
+	"ionice-class":          "ionice_class",
+	"ionice-level":          "ionice_level",
+	"cpu-affinity":          "cpu_affinity",
+}
+
+// recordFlagOrigins records the options that are set as the origins of the config values.
+func recordFlagOrigins(c *crun.Crun) {
+	flag.Visit(func(f *flag.Flag) {
+		origin := "flag --" + f.Name
+		if len(f.Name) == 1 {
+			origin = "flag -" + f.Name
+		}
+
+		switch f.Name {
+		case "limit":
+			for _, l := range *f.Value.(*stringSlice) {
+				c.Config.SetOrigin("limits."+strings.SplitN(l, "=", 2)[0], origin)
+			}
+			return
+		case "e", "env", "pre", "notice", "success", "failure", "post", "heartbeat":
+			c.Config.AppendOrigin(flagConfigKeys[f.Name], origin)
+			return
+		}
+
+		if key, ok := flagConfigKeys[f.Name]; ok {
+			c.Config.SetOrigin(key, origin)
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package crun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Built-in handler types. They are the same as 'crun-handler-slack' and 'crun-handler-teams' in 'handlers' directory.
+const (
+	BuiltinHandlerSlack = "slack"
+	BuiltinHandlerTeams = "teams"
+)
+
+var BuiltinHandlerTypes = []string{BuiltinHandlerSlack, BuiltinHandlerTeams}
+
+// Message formats of the teams handler.
+const (
+	TeamsFormatText  = "text"
+	TeamsFormatFacts = "facts"
+)
+
+// builtinHandlerItems are the items of the result that the built-in handlers report, and the keys of them in the result JSON.
+var builtinHandlerItems = []struct {
+	name string
+	key  string
+}{
+	{"Command", "command"},
+	{"CommandArgs", "commandArgs"},
+	{"Tag", "tag"},
+	{"Output", "output"},
+	{"Stdout", "stdout"},
+	{"Stderr", "stderr"},
+	{"ExitCode", "exitCode"},
+	{"Signaled", "signaled"},
+	{"Result", "result"},
+	{"Pid", "pid"},
+	{"StartAt", "startAt"},
+	{"EndAt", "endAt"},
+	{"Hostname", "hostname"},
+	{"SystemTime", "systemTime"},
+	{"UserTime", "userTime"},
+}
+
+// builtinHandlerItem is an item of the result in the message.
+type builtinHandlerItem struct {
+	name  string
+	value interface{}
+}
+
+func (h *Handler) validateBuiltin() error {
+	if !hasString(BuiltinHandlerTypes, h.Type) {
+		return fmt.Errorf("handler has unknown type '%s'. must be 'slack' or 'teams'", h.Type)
+	}
+	if h.Command != "" {
+		return fmt.Errorf("%s handler can not have 'command'", h.Type)
+	}
+	if h.WebhookURL == "" {
+		return fmt.Errorf("%s handler requires 'webhook_url'", h.Type)
+	}
+	for _, item := range h.Items {
+		if item != "all" && builtinHandlerItemKey(item) == "" {
+			return fmt.Errorf("%s handler has unknown item '%s'", h.Type, item)
+		}
+	}
+	if h.Type == BuiltinHandlerTeams && h.Format != "" && h.Format != TeamsFormatText && h.Format != TeamsFormatFacts {
+		return fmt.Errorf("teams handler has invalid format '%s'. must be 'text' or 'facts'", h.Format)
+	}
+	return nil
+}
+
+func builtinHandlerItemKey(name string) string {
+	for _, item := range builtinHandlerItems {
+		if item.name == name {
+			return item.key
+		}
+	}
+	return ""
+}
+
+// execBuiltinHandler posts the result to the webhook of the built-in handler.
+func (c *Crun) execBuiltinHandler(h *Handler, reportJSON []byte, handlerType string, hr *structs.HandlerReport) error {
+	var msg interface{}
+	var err error
+	switch h.Type {
+	case BuiltinHandlerSlack:
+		msg, err = h.slackMessage(reportJSON)
+	case BuiltinHandlerTeams:
+		msg, err = h.teamsMessage(reportJSON)
+	default:
+		err = fmt.Errorf("unknown handler type '%s'", h.Type)
+	}
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.handlerContext(handlerType)
+	timeout := c.Config.handlerTimeout(h)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout.Duration())
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("it took time over %s", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, outputTailSize))
+	hr.Output = string(respBody)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		hr.ExitCode = 1
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	hr.ExitCode = 0
+	return nil
+}
+
+// reportItems returns the items of the result that are selected by 'items'.
+// Like the handler scripts, an item that the result does not have, or that is false, is not reported.
+func (h *Handler) reportItems(reportJSON []byte) ([]*builtinHandlerItem, error) {
+	report := map[string]interface{}{}
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		return nil, err
+	}
+
+	all := len(h.Items) == 0 || hasString(h.Items, "all")
+	items := []*builtinHandlerItem{}
+	for _, item := range builtinHandlerItems {
+		if !all && !hasString(h.Items, item.name) {
+			continue
+		}
+		value, ok := report[item.key]
+		if !ok || value == nil || value == false {
+			continue
+		}
+		if item.key == "commandArgs" {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			value = string(b)
+		}
+		items = append(items, &builtinHandlerItem{name: item.name, value: value})
+	}
+	return items, nil
+}
+
+type slackMessage struct {
+	Channel     string             `json:"channel,omitempty"`
+	Username    string             `json:"username,omitempty"`
+	Text        string             `json:"text"`
+	Attachments []*slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color  string        `json:"color,omitempty"`
+	Fields []*slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string      `json:"title"`
+	Value interface{} `json:"value"`
+}
+
+func (h *Handler) slackMessage(reportJSON []byte) (*slackMessage, error) {
+	items, err := h.reportItems(reportJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []*slackField{}
+	for _, item := range items {
+		fields = append(fields, &slackField{Title: item.name, Value: item.value})
+	}
+
+	text := h.Text
+	if text == "" {
+		text = "Reported by crun-handler-slack"
+	}
+	return &slackMessage{
+		Channel:  h.Channel,
+		Username: h.Username,
+		Text:     text,
+		Attachments: []*slackAttachment{
+			{Color: h.Color, Fields: fields},
+		},
+	}, nil
+}
+
+// teamsMessage is a message card.
+// see https://docs.microsoft.com/en-us/outlook/actionable-messages/message-card-reference
+type teamsMessage struct {
+	Type       string          `json:"@type"`
+	Context    string          `json:"@context"`
+	Text       string          `json:"text"`
+	ThemeColor string          `json:"themeColor,omitempty"`
+	Sections   []*teamsSection `json:"sections,omitempty"`
+}
+
+type teamsSection struct {
+	Facts []*teamsFact `json:"facts"`
+}
+
+type teamsFact struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func (h *Handler) teamsMessage(reportJSON []byte) (*teamsMessage, error) {
+	items, err := h.reportItems(reportJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	text := h.Text
+	if text == "" {
+		text = "Reported by crun-handler-teams"
+	}
+	msg := &teamsMessage{
+		Type:       "MessageCard",
+		Context:    "http://schema.org/extensions",
+		ThemeColor: h.Color,
+	}
+
+	if h.Format == TeamsFormatFacts {
+		facts := []*teamsFact{}
+		for _, item := range items {
+			facts = append(facts, &teamsFact{Name: item.name, Value: item.value})
+		}
+		msg.Text = text
+		msg.Sections = []*teamsSection{{Facts: facts}}
+		return msg, nil
+	}
+
+	for _, item := range items {
+		value := formatItemValue(item.value)
+		if value == "" {
+			text += "\n## " + item.name + "\n\n"
+		} else {
+			text += "\n## " + item.name + "\n`" + value + "`\n"
+		}
+	}
+	msg.Text = text
+	return msg, nil
+}
+
+// formatItemValue formats the value of the item like Lua's string concatenation.
+func formatItemValue(v interface{}) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case float64:
+		if vv == math.Trunc(vv) && math.Abs(vv) < 1e15 {
+			return strconv.FormatInt(int64(vv), 10)
+		}
+		return strconv.FormatFloat(vv, 'g', 14, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
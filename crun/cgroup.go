@@ -0,0 +1,241 @@
+package crun
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DefaultCgroupParent = "/sys/fs/cgroup/crun.slice"
+
+// CgroupConfig is the settings to confine the command in a transient cgroup v2 subgroup.
+type CgroupConfig struct {
+	Parent    string `toml:"parent"`
+	MemoryMax string `toml:"memory_max"`
+	CpuMax    string `toml:"cpu_max"`
+	PidsMax   int64  `toml:"pids_max"`
+	IoWeight  int64  `toml:"io_weight"`
+}
+
+// Enabled reports whether the command should run in a cgroup.
+func (c *CgroupConfig) Enabled() bool {
+	return c.MemoryMax != "" || c.CpuMax != "" || c.PidsMax != 0 || c.IoWeight != 0
+}
+
+func (c *CgroupConfig) validate() error {
+	if c.PidsMax < 0 {
+		return fmt.Errorf("invalid cgroup pids_max %d", c.PidsMax)
+	}
+	if c.IoWeight != 0 && (c.IoWeight < 1 || c.IoWeight > 10000) {
+		return fmt.Errorf("invalid cgroup io_weight %d. must be in the range 1-10000", c.IoWeight)
+	}
+	return nil
+}
+
+// files returns the interface files and the values to write to the cgroup.
+func (c *CgroupConfig) files() map[string]string {
+	files := map[string]string{}
+	if c.MemoryMax != "" {
+		files["memory.max"] = c.MemoryMax
+	}
+	if c.CpuMax != "" {
+		files["cpu.max"] = c.CpuMax
+	}
+	if c.PidsMax != 0 {
+		files["pids.max"] = strconv.FormatInt(c.PidsMax, 10)
+	}
+	if c.IoWeight != 0 {
+		files["io.weight"] = "default " + strconv.FormatInt(c.IoWeight, 10)
+	}
+	return files
+}
+
+func (c *CgroupConfig) controllers() []string {
+	controllers := []string{}
+	if c.MemoryMax != "" {
+		controllers = append(controllers, "memory")
+	}
+	if c.CpuMax != "" {
+		controllers = append(controllers, "cpu")
+	}
+	if c.PidsMax != 0 {
+		controllers = append(controllers, "pids")
+	}
+	if c.IoWeight != 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+type cgroup struct {
+	path string
+}
+
+// createCgroup creates a transient cgroup for the command under the parent cgroup.
+func createCgroup(config *CgroupConfig) (*cgroup, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("cgroup is supported only on linux")
+	}
+
+	parent := config.Parent
+	if parent == "" {
+		parent = DefaultCgroupParent
+	}
+
+	if err := checkCgroup2(parent); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	if err := enableCgroupControllers(parent, config.controllers()); err != nil {
+		return nil, fmt.Errorf("failed to enable cgroup controllers in '%s': %v", parent, err)
+	}
+
+	cg := &cgroup{
+		path: filepath.Join(parent, fmt.Sprintf("crun-%d", os.Getpid())),
+	}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, err
+	}
+
+	for name, value := range config.files() {
+		if err := cg.write(name, value); err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("failed to set cgroup %s: %v", name, err)
+		}
+	}
+
+	return cg, nil
+}
+
+// checkCgroup2 checks that the parent is in the cgroup v2 hierarchy, so that the command never runs without the limits.
+// The parent may not exist yet, so its nearest existing ancestor is checked.
+func checkCgroup2(parent string) error {
+	dir := parent
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		up := filepath.Dir(dir)
+		if up == dir {
+			break
+		}
+		dir = up
+	}
+	ok, err := isCgroup2(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check cgroup parent '%s': %v", parent, err)
+	}
+	if !ok {
+		return fmt.Errorf("cgroup parent '%s' is not in a cgroup v2 filesystem", parent)
+	}
+	return nil
+}
+
+// enableCgroupControllers enables the controllers for the children of the cgroup from the top of the hierarchy.
+func enableCgroupControllers(dir string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if _, err := os.Stat(filepath.Join(parent, "cgroup.subtree_control")); err == nil {
+			// the controllers may already be enabled in the ancestors by others.
+			enableCgroupControllers(parent, controllers)
+		}
+	}
+
+	values := []string{}
+	for _, c := range controllers {
+		values = append(values, "+"+c)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(values, " ")), 0644)
+}
+
+func (cg *cgroup) write(name, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.path, name), []byte(value), 0644)
+}
+
+func (cg *cgroup) read(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cg.path, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readKeyedFile reads a flat keyed file like 'memory.events' and 'cpu.stat'.
+func (cg *cgroup) readKeyedFile(name string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(cg.path, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		ret[fields[0]] = v
+	}
+	return ret, scanner.Err()
+}
+
+// report reads the resource usage of the cgroup.
+func (cg *cgroup) report() *structs.CgroupReport {
+	r := &structs.CgroupReport{
+		Path: cg.path,
+	}
+
+	if s, err := cg.read("memory.peak"); err == nil {
+		r.MemoryPeak, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if events, err := cg.readKeyedFile("memory.events"); err == nil {
+		r.OomKill = events["oom_kill"]
+	}
+	if stat, err := cg.readKeyedFile("cpu.stat"); err == nil {
+		r.CpuUsage = usecToSeconds(stat["usage_usec"])
+		r.CpuUser = usecToSeconds(stat["user_usec"])
+		r.CpuSystem = usecToSeconds(stat["system_usec"])
+		r.NrThrottled = stat["nr_throttled"]
+		r.Throttled = usecToSeconds(stat["throttled_usec"])
+	}
+
+	return r
+}
+
+// remove kills the processes that remain in the cgroup and removes the cgroup.
+func (cg *cgroup) remove() error {
+	// cgroup.kill is available since linux 5.14
+	cg.write("cgroup.kill", "1")
+
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup '%s': %v", cg.path, err)
+}
+
+func usecToSeconds(usec int64) float64 {
+	return float64(usec) / float64(time.Second/time.Microsecond)
+}
@@ -0,0 +1,17 @@
+package crun
+
+import (
+	"syscall"
+)
+
+// cgroup2SuperMagic is the filesystem type of the cgroup v2 hierarchy (CGROUP2_SUPER_MAGIC).
+const cgroup2SuperMagic = 0x63677270
+
+// isCgroup2 reports whether the path is on the cgroup v2 filesystem.
+func isCgroup2(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	return st.Type == cgroup2SuperMagic, nil
+}
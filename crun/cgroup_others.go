@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package crun
+
+func isCgroup2(path string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,175 @@
+package crun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"github.com/yuin/gopher-lua"
+	"path"
+	"time"
+)
+
+// HandlerCondition is the conditions to run a handler. All specified conditions must be satisfied.
+type HandlerCondition struct {
+	// ExitCodes matches any of the exit codes of the command.
+	ExitCodes []int `toml:"exit_codes"`
+	// TagGlob matches the tag of the job with the glob pattern.
+	TagGlob string `toml:"tag_glob"`
+	// MinDuration matches if the command took time over it.
+	MinDuration Duration `toml:"min_duration"`
+	// HostnameGlob matches the hostname with the glob pattern.
+	HostnameGlob string `toml:"hostname_glob"`
+	// Expr is a Lua expression that is evaluated with the 'report' table and the 'duration' number.
+	Expr string `toml:"expr"`
+}
+
+func (cond *HandlerCondition) validate() error {
+	if _, err := path.Match(cond.TagGlob, ""); err != nil {
+		return fmt.Errorf("invalid tag_glob '%s': %v", cond.TagGlob, err)
+	}
+	if _, err := path.Match(cond.HostnameGlob, ""); err != nil {
+		return fmt.Errorf("invalid hostname_glob '%s': %v", cond.HostnameGlob, err)
+	}
+	if cond.MinDuration < 0 {
+		return fmt.Errorf("invalid min_duration %s", cond.MinDuration)
+	}
+	if cond.Expr != "" {
+		L := lua.NewState(lua.Options{SkipOpenLibs: true})
+		defer L.Close()
+		if _, err := L.LoadString("return " + cond.Expr); err != nil {
+			return fmt.Errorf("invalid expr '%s': %v", cond.Expr, err)
+		}
+	}
+	return nil
+}
+
+// match reports whether the report satisfies the conditions.
+// reportJSON must be the JSON of the report, that is the same as the handler receives.
+func (cond *HandlerCondition) match(reportJSON []byte) (bool, error) {
+	r := &structs.Report{}
+	if err := json.Unmarshal(reportJSON, r); err != nil {
+		return false, err
+	}
+
+	if len(cond.ExitCodes) > 0 {
+		matched := false
+		for _, code := range cond.ExitCodes {
+			if r.ExitCode == code {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if cond.TagGlob != "" {
+		if matched, _ := path.Match(cond.TagGlob, r.Tag); !matched {
+			return false, nil
+		}
+	}
+
+	if cond.HostnameGlob != "" {
+		if matched, _ := path.Match(cond.HostnameGlob, r.Hostname); !matched {
+			return false, nil
+		}
+	}
+
+	duration := reportDuration(r)
+	if cond.MinDuration > 0 && duration < cond.MinDuration.Duration() {
+		return false, nil
+	}
+
+	if cond.Expr != "" {
+		return evalConditionExpr(cond.Expr, reportJSON, duration)
+	}
+
+	return true, nil
+}
+
+// reportDuration returns the time that the command took. If the command is still running, it returns the elapsed time.
+func reportDuration(r *structs.Report) time.Duration {
+	if r.StartAt == nil {
+		return 0
+	}
+	if r.EndAt == nil {
+		return time.Since(*r.StartAt)
+	}
+	return r.EndAt.Sub(*r.StartAt)
+}
+
+// conditionExprTimeout is the time that an expression of a condition can run.
+var conditionExprTimeout = 1 * time.Second
+
+// evalConditionExpr evaluates the expression in a Lua state that has only the base, string and math libraries.
+func evalConditionExpr(expr string, reportJSON []byte, duration time.Duration) (bool, error) {
+	var report interface{}
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		return false, err
+	}
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// an expression can not load code from files and strings.
+	for _, fn := range luaSandboxDisabledFunctions["_G"] {
+		L.SetGlobal(fn, lua.LNil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conditionExprTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	L.SetGlobal("report", toLValue(L, report))
+	L.SetGlobal("duration", lua.LNumber(duration.Seconds()))
+
+	if err := L.DoString("return " + expr); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return false, fmt.Errorf("expr '%s' took time over %s", expr, conditionExprTimeout)
+		}
+		return false, fmt.Errorf("failed to evaluate expr '%s': %v", expr, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	return lua.LVAsBool(ret), nil
+}
+
+// toLValue converts a value decoded from JSON to a Lua value.
+func toLValue(L *lua.LState, v interface{}) lua.LValue {
+	switch vv := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(vv)
+	case float64:
+		return lua.LNumber(vv)
+	case string:
+		return lua.LString(vv)
+	case []interface{}:
+		tb := L.NewTable()
+		for _, e := range vv {
+			tb.Append(toLValue(L, e))
+		}
+		return tb
+	case map[string]interface{}:
+		tb := L.NewTable()
+		for k, e := range vv {
+			tb.RawSetString(k, toLValue(L, e))
+		}
+		return tb
+	}
+	return lua.LString(fmt.Sprintf("%v", v))
+}
@@ -3,56 +3,133 @@ package crun
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"os"
+	"strconv"
 	"strings"
 )
 
 var DefaultMutexdir = "/tmp/crun"
 
 type Config struct {
-	PreHandlers        []string          `toml:"pre"`
-	NoticeHandlers     []string          `toml:"notice"`
-	PostHandlers       []string          `toml:"post"`
-	SuccessHandlers    []string          `toml:"success"`
-	FailureHandlers    []string          `toml:"failure"`
-	LogFile            string            `toml:"log_file"`
-	LogPrefix          string            `toml:"log_prefix"`
-	Tag                string            `toml:"tag"`
-	Quiet              bool              `toml:"quiet"`
-	WorkingDirectory   string            `toml:"working_directory"`
-	Mutexdir           string            `toml:"mutexdir"`
-	Mutex              string            `toml:"mutex"`
-	Environment        []string          `toml:"environment"`
-	EnvironmentMap     map[string]string `toml:"-"`
-	WithoutOverlapping bool              `toml:"without_overlapping"`
-	User               string            `toml:"user"`
-	Group              string            `toml:"group"`
-	Timeout            int64             `toml:"timeout"`
+	PreHandlers         []string                  `toml:"pre"`
+	NoticeHandlers      []string                  `toml:"notice"`
+	PostHandlers        []string                  `toml:"post"`
+	SuccessHandlers     []string                  `toml:"success"`
+	FailureHandlers     []string                  `toml:"failure"`
+	HeartbeatHandlers   []string                  `toml:"heartbeat"`
+	HeartbeatInterval   Duration                  `toml:"heartbeat_interval"`
+	LogFile             string                    `toml:"log_file"`
+	LogPrefix           string                    `toml:"log_prefix"`
+	LogFileMode         string                    `toml:"log_file_mode"`
+	LogFileOwner        string                    `toml:"log_file_owner"`
+	Tag                 string                    `toml:"tag"`
+	Quiet               bool                      `toml:"quiet"`
+	WorkingDirectory    string                    `toml:"working_directory"`
+	Mutexdir            string                    `toml:"mutexdir"`
+	Mutex               string                    `toml:"mutex"`
+	Environment         []string                  `toml:"environment"`
+	EnvironmentMap      map[string]string         `toml:"-"`
+	WithoutOverlapping  bool                      `toml:"without_overlapping"`
+	User                string                    `toml:"user"`
+	Group               string                    `toml:"group"`
+	HandlerUser         string                    `toml:"handler_user"`
+	HandlerGroup        string                    `toml:"handler_group"`
+	Handlers            []*Handler                `toml:"handler"`
+	HandlerTimeout      Duration                  `toml:"handler_timeout"`
+	HandlerRetries      int                       `toml:"handler_retries"`
+	HandlerFailure      string                    `toml:"handler_failure"`
+	HandlerMode         map[string]string         `toml:"handler_mode"`
+	MaxParallelHandlers int                       `toml:"max_parallel_handlers"`
+	Timeout             Duration                  `toml:"timeout"`
+	Limits              Limits                    `toml:"limits"`
+	Cgroup              CgroupConfig              `toml:"cgroup"`
+	Nice                int                       `toml:"nice"`
+	IoniceClass         string                    `toml:"ionice_class"`
+	IoniceLevel         int                       `toml:"ionice_level"`
+	CpuAffinity         []int                     `toml:"cpu_affinity"`
+	PingURL             string                    `toml:"ping_url"`
+	PingStartSuffix     string                    `toml:"ping_start_suffix"`
+	PingSuccessSuffix   string                    `toml:"ping_success_suffix"`
+	PingFailureSuffix   string                    `toml:"ping_failure_suffix"`
+	PingRetries         int                       `toml:"ping_retries"`
+	PingTimeout         Duration                  `toml:"ping_timeout"`
+	PingSendOutput      bool                      `toml:"ping_send_output"`
+	MetricsTextfileDir  string                    `toml:"metrics_textfile_dir"`
+	Metrics             MetricsConfig             `toml:"metrics"`
+	Tracing             TracingConfig             `toml:"tracing"`
+	LuaHandlers         map[string][]string       `toml:"lua_handlers"`
+	LuaHandlerMemoryMax string                    `toml:"lua_handler_memory_max"`
+	LuaSandbox          LuaSandbox                `toml:"lua_sandbox"`
+	LuaPath             string                    `toml:"lua_path"`
+	Command             CommandArgs               `toml:"command"`
+	Jobs                map[string]toml.Primitive `toml:"jobs"`
+
+	// origins are where the values came from.
+	origins map[string]string
+	// jobLayers are the definitions of the jobs in the config files.
+	jobLayers map[string][]*jobLayer
+	// files are the config files that have been loaded.
+	files []*loadedConfigFile
+	// luaFunctions are the handlers that are Lua functions in Lua config files.
+	luaFunctions map[string]*luaFunction
+	// expanded is true after the variables in the settings have been expanded.
+	expanded bool
 }
 
 func newConfig() *Config {
 	return &Config{
-		PreHandlers:        []string{},
-		NoticeHandlers:     []string{},
-		PostHandlers:       []string{},
-		SuccessHandlers:    []string{},
-		FailureHandlers:    []string{},
+		PreHandlers:         []string{},
+		NoticeHandlers:      []string{},
+		PostHandlers:        []string{},
+		SuccessHandlers:     []string{},
+		FailureHandlers:     []string{},
+		HeartbeatHandlers:   []string{},
+		Handlers:            []*Handler{},
+		LuaHandlers:         map[string][]string{},
+		LuaHandlerMemoryMax: DefaultLuaHandlerMemoryMax,
+		LuaSandbox: LuaSandbox{
+			Modules:          append([]string{}, DefaultLuaSandboxModules...),
+			Timeout:          DefaultLuaSandboxTimeout,
+			InstructionLimit: DefaultLuaSandboxInstructionLimit,
+			CallStackSize:    DefaultLuaSandboxCallStackSize,
+			RegistryMaxSize:  DefaultLuaSandboxRegistryMaxSize,
+		},
+		HandlerMode:        map[string]string{},
 		Environment:        []string{},
 		Mutexdir:           DefaultMutexdir,
+		LogFileMode:        "0644",
 		EnvironmentMap:     map[string]string{},
 		WithoutOverlapping: false,
 		Timeout:            0,
+		Cgroup: CgroupConfig{
+			Parent: DefaultCgroupParent,
+		},
+		IoniceLevel:       4,
+		CpuAffinity:       []int{},
+		PingStartSuffix:   DefaultPingStartSuffix,
+		PingSuccessSuffix: DefaultPingSuccessSuffix,
+		PingFailureSuffix: DefaultPingFailureSuffix,
+		PingTimeout:       DefaultPingTimeout,
+		Metrics: MetricsConfig{
+			Prefix:  DefaultMetricsPrefix,
+			Timeout: DefaultMetricsTimeout,
+		},
+		origins:      map[string]string{},
+		jobLayers:    map[string][]*jobLayer{},
+		luaFunctions: map[string]*luaFunction{},
+		Tracing: TracingConfig{
+			ServiceName: DefaultTracingServiceName,
+			Headers:     map[string]string{},
+			Timeout:     DefaultTracingTimeout,
+		},
 	}
 }
-func (c *Config) LoadConfigFile(path string) error {
-	_, err := toml.DecodeFile(path, c)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
 
+// Prepare makes the config ready to run a job.
+// First, it expands the variables like '${VAR}' and '{{.Tag}}' in the settings (see expand). Then it validates the settings.
 func (c *Config) Prepare() error {
+	c.expand()
+
 	for _, e := range c.Environment {
 		splitString := strings.SplitN(e, "=", 2)
 		if len(splitString) != 2 {
@@ -60,5 +137,69 @@ func (c *Config) Prepare() error {
 		}
 		c.EnvironmentMap[splitString[0]] = splitString[1]
 	}
+
+	for _, h := range c.Handlers {
+		if err := h.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("invalid heartbeat interval %s", c.HeartbeatInterval)
+	}
+
+	if c.HandlerTimeout < 0 {
+		return fmt.Errorf("invalid handler timeout %s", c.HandlerTimeout)
+	}
+	if c.HandlerRetries < 0 {
+		return fmt.Errorf("invalid handler retries %d", c.HandlerRetries)
+	}
+	if c.HandlerFailure != "" && !hasString(HandlerFailures, c.HandlerFailure) {
+		return fmt.Errorf("invalid handler failure policy '%s'. must be 'ignore', 'warn' or 'fail_job'", c.HandlerFailure)
+	}
+
+	if err := c.validateHandlerMode(); err != nil {
+		return err
+	}
+
+	if err := c.validateLuaHandlers(); err != nil {
+		return err
+	}
+
+	if _, err := c.logFileMode(); err != nil {
+		return err
+	}
+
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Cgroup.validate(); err != nil {
+		return err
+	}
+
+	if err := c.validateScheduling(); err != nil {
+		return err
+	}
+
+	if err := c.validatePing(); err != nil {
+		return err
+	}
+
+	if err := c.Metrics.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
 	return nil
 }
+
+func (c *Config) logFileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.LogFileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid log file mode '%s'. must be an octal number like '0644'", c.LogFileMode)
+	}
+	return os.FileMode(mode), nil
+}
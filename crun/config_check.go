@@ -0,0 +1,312 @@
+package crun
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/kballard/go-shellquote"
+	"github.com/lestrrat-go/strftime"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ConfigProblem is a problem in the config that is found by Check.
+type ConfigProblem struct {
+	// Location is 'file:line', the file, or the origin of the value like 'env CRUN_CONFIG_TIMEOUT'. It is empty if it is unknown.
+	Location string
+	Message  string
+}
+
+func (p *ConfigProblem) String() string {
+	if p.Location == "" {
+		return p.Message
+	}
+	return p.Location + ": " + p.Message
+}
+
+// loadedConfigFile is a config file that has been loaded.
+type loadedConfigFile struct {
+	path     string
+	metadata toml.MetaData
+}
+
+// Check validates the config more strictly than Prepare, and returns all the problems that are found.
+// It reports unknown keys, invalid values, unknown users and groups, handlers that can not run,
+// the directories that crun can not write, and invalid strftime patterns.
+func (c *Config) Check() []*ConfigProblem {
+	problems := []*ConfigProblem{}
+	add := func(location, format string, args ...interface{}) {
+		problems = append(problems, &ConfigProblem{Location: location, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// unknown keys
+	for _, f := range c.files {
+		for _, key := range f.metadata.Undecoded() {
+			if len(key) > 0 && key[0] == "jobs" {
+				continue
+			}
+			add(fileLocation(f.path, key), "unknown key '%s'", key)
+		}
+	}
+	for _, name := range c.JobNames() {
+		for _, layer := range c.jobLayers[name] {
+			job := newConfig()
+			if err := layer.metadata.PrimitiveDecode(layer.primitive, job); err != nil {
+				add(layer.path, "invalid job '%s': %v", name, err)
+				continue
+			}
+			prefix := "jobs." + name + "."
+			for _, key := range layer.metadata.Undecoded() {
+				if strings.HasPrefix(key.String(), prefix) {
+					add(fileLocation(layer.path, key), "unknown key '%s'", key)
+				}
+			}
+			if len(job.Command) > 0 {
+				if err := checkExecutable(job.Command[0]); err != nil {
+					add(fileLocation(layer.path, toml.Key{"jobs", name, "command"}), "command of job '%s' can not run: %v", name, err)
+				}
+			}
+		}
+	}
+
+	// users and groups
+	for _, key := range []string{"user", "handler_user"} {
+		if name := c.field(key).String(); name != "" {
+			if _, err := LookupUserStruct(name); err != nil {
+				add(c.location(key, ""), "unknown %s '%s': %v", key, name, err)
+			}
+		}
+	}
+	for _, key := range []string{"group", "handler_group"} {
+		if name := c.field(key).String(); name != "" {
+			if _, err := LookupGroup(name); err != nil {
+				add(c.location(key, ""), "unknown %s '%s': %v", key, name, err)
+			}
+		}
+	}
+	if c.LogFileOwner != "" {
+		if _, _, err := lookupOwner(c.LogFileOwner); err != nil {
+			add(c.location("log_file_owner", ""), "invalid log_file_owner '%s': %v", c.LogFileOwner, err)
+		}
+	}
+
+	// handlers
+	checked := map[*Handler]bool{}
+	for _, handlerType := range HandlerTypes {
+		for _, h := range c.handlers(handlerType) {
+			if checked[h] {
+				continue
+			}
+			checked[h] = true
+
+			key := handlerType
+			if hasHandler(c.Handlers, h) {
+				key = "handler"
+			}
+			location := c.location(key, h.Command)
+			if c.luaFunction(h.Command) != nil || h.Type != "" {
+				continue
+			}
+			if h.luaScript {
+				location = c.location("lua_handlers."+handlerType, h.Command)
+				if err := checkLuaScript(c.expandString(h.Command)); err != nil {
+					add(location, "lua handler '%s' can not run: %v", h.Command, err)
+				}
+				continue
+			}
+
+			args, err := shellquote.Split(c.expandString(h.Command))
+			if err != nil {
+				add(location, "unparsable handler '%s': %v", h.Command, err)
+				continue
+			}
+			if len(args) == 0 {
+				add(location, "empty handler")
+				continue
+			}
+			if err := checkExecutable(args[0]); err != nil {
+				add(location, "handler '%s' can not run: %v", h.Command, err)
+			}
+			if h.User != "" {
+				if _, err := LookupUserStruct(h.User); err != nil {
+					add(location, "handler '%s' has unknown user '%s': %v", h.Command, h.User, err)
+				}
+			}
+			if h.Group != "" {
+				if _, err := LookupGroup(h.Group); err != nil {
+					add(location, "handler '%s' has unknown group '%s': %v", h.Command, h.Group, err)
+				}
+			}
+		}
+	}
+
+	if len(c.Command) > 0 {
+		if err := checkExecutable(c.Command[0]); err != nil {
+			add(c.location("command", ""), "command '%s' can not run: %v", c.Command[0], err)
+		}
+	}
+
+	// log file and mutex directory
+	if c.LogFile != "" {
+		logfile, err := strftime.Format(c.expandString(c.LogFile), time.Now())
+		if err != nil {
+			add(c.location("log_file", ""), "invalid strftime pattern in log_file '%s': %v", c.LogFile, err)
+		} else if err := checkWritableDir(filepath.Dir(logfile)); err != nil {
+			add(c.location("log_file", ""), "can not write log_file '%s': %v", logfile, err)
+		}
+	}
+	mutexdir := c.expandString(c.Mutexdir)
+	if err := checkWritableDir(mutexdir); err != nil {
+		add(c.location("mutexdir", ""), "can not write mutexdir '%s': %v", mutexdir, err)
+	}
+
+	// the other values
+	if err := c.Prepare(); err != nil {
+		add("", "%v", err)
+	}
+
+	return problems
+}
+
+func hasHandler(handlers []*Handler, h *Handler) bool {
+	for _, v := range handlers {
+		if v == h {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExecutable checks that the command can be executed.
+func checkExecutable(name string) error {
+	if !strings.Contains(name, "/") {
+		_, err := exec.LookPath(name)
+		return err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("'%s' is not executable", name)
+	}
+	return nil
+}
+
+// checkLuaScript checks that the Lua script exists and can be compiled.
+func checkLuaScript(path string) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	_, err := L.LoadFile(path)
+	return err
+}
+
+// checkWritableDir checks that crun can create files in the directory.
+// If the directory does not exist, it checks the nearest existing parent, because crun creates the directories of mutexdir and log_file.
+func checkWritableDir(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("'%s' is not a directory", dir)
+			}
+			return syscall.Access(dir, 0x2 /* W_OK */)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+}
+
+// location returns the location of the value of the key.
+// If the value came from config files, it finds the line that has the needle, or the key if needle is empty.
+func (c *Config) location(key, needle string) string {
+	origin := c.Origin(key)
+	if origin == OriginDefault {
+		return ""
+	}
+
+	for _, part := range strings.Split(origin, originSeparator) {
+		if i := strings.Index(part, "' in "); strings.HasPrefix(part, "job '") && i >= 0 {
+			part = part[i+len("' in "):]
+		}
+		if _, err := os.Stat(part); err != nil {
+			continue
+		}
+		if needle == "" {
+			return fileLocation(part, strings.Split(key, "."))
+		}
+		if line := textLine(part, needle); line > 0 {
+			return fmt.Sprintf("%s:%d", part, line)
+		}
+	}
+	return origin
+}
+
+// fileLocation returns 'file:line' of the key in the TOML file, or the file if the line is not found.
+func fileLocation(path string, key toml.Key) string {
+	for k := key; len(k) > 0; k = k[:len(k)-1] {
+		if line := keyLine(path, k); line > 0 {
+			return fmt.Sprintf("%s:%d", path, line)
+		}
+	}
+	return path
+}
+
+// keyLine returns the line number of the key in the TOML file. It returns 0 if it is not found.
+func keyLine(path string, key toml.Key) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	target := key.String()
+	table := ""
+	for i, line := range strings.Split(string(b), "\n") {
+		l := strings.TrimSpace(line)
+		if strings.HasPrefix(l, "[") {
+			if j := strings.Index(l, "#"); j >= 0 {
+				l = strings.TrimSpace(l[:j])
+			}
+			table = strings.TrimSpace(strings.Trim(l, "[]"))
+			if table == target {
+				return i + 1
+			}
+			continue
+		}
+		if j := strings.Index(l, "="); j > 0 {
+			k := strings.Trim(strings.TrimSpace(l[:j]), `"'`)
+			if table != "" {
+				k = table + "." + k
+			}
+			if k == target {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// textLine returns the line number that has the text first. It returns 0 if it is not found.
+func textLine(path, text string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for i, line := range strings.Split(string(b), "\n") {
+		if strings.Contains(line, text) {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package crun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// luaFunctionPrefix is the prefix of the command of a handler that is a Lua function in a Lua config file.
+const luaFunctionPrefix = "lua:function:"
+
+// luaConfigState is the Lua state of a Lua config file. It is kept open to run the handlers that are Lua functions.
+type luaConfigState struct {
+	L *lua.LState
+	// mu serializes the calls of the functions, because a Lua state is not goroutine-safe.
+	mu sync.Mutex
+	// out is where 'print' writes while a function runs.
+	out io.Writer
+}
+
+// luaFunction is a handler that is a Lua function.
+type luaFunction struct {
+	state *luaConfigState
+	fn    *lua.LFunction
+}
+
+// loadLuaConfigFile runs the Lua config file and loads the table that it returns.
+// The table has the same structure as the TOML config, and it is loaded in the same way through TOML.
+// Lua functions in the lists of handlers and 'command' of '[[handler]]' are registered as handlers that run in the crun process.
+func (c *Config) loadLuaConfigFile(path string) error {
+	state := &luaConfigState{L: lua.NewState(), out: os.Stdout}
+	L := state.L
+	openLibs(L)
+	// the functions in the config run in the crun process as handlers, and 'os.exit' would stop crun.
+	disableLuaExit(L, "os.exit is not allowed in Lua config files. raise an error instead")
+	L.PreloadModule("crun", luaConfigModuleLoader)
+	L.SetGlobal("print", L.NewFunction(state.print))
+
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	tb, ok := ret.(*lua.LTable)
+	if !ok {
+		L.Close()
+		return fmt.Errorf("config file '%s' must return a table, but it returns %s", path, ret.Type())
+	}
+
+	numFunctions := len(c.luaFunctions)
+	v, err := c.fromLuaConfig(state, tb, nil)
+	if err != nil {
+		L.Close()
+		return fmt.Errorf("invalid config in '%s': %v", path, err)
+	}
+	if len(c.luaFunctions) == numFunctions {
+		L.Close()
+	}
+
+	buf := &bytes.Buffer{}
+	if v != nil {
+		if err := toml.NewEncoder(buf).Encode(v); err != nil {
+			return fmt.Errorf("invalid config in '%s': %v", path, err)
+		}
+	}
+	return c.loadConfig(path, buf.String())
+}
+
+// fromLuaConfig converts the Lua value in the config to a value that can be encoded to TOML.
+// An empty table is converted to nil, because it is unknown whether it is an array or a table.
+func (c *Config) fromLuaConfig(state *luaConfigState, v lua.LValue, key []string) (interface{}, error) {
+	switch vv := v.(type) {
+	case lua.LBool:
+		return bool(vv), nil
+	case lua.LString:
+		return string(vv), nil
+	case lua.LNumber:
+		if f := float64(vv); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), nil
+		}
+		return float64(vv), nil
+	case *lua.LFunction:
+		if !isHandlerCommandKey(key) {
+			return nil, fmt.Errorf("'%s' can not be a function", strings.Join(key, "."))
+		}
+		name := fmt.Sprintf("%s%d", luaFunctionPrefix, len(c.luaFunctions)+1)
+		c.luaFunctions[name] = &luaFunction{state: state, fn: vv}
+		return name, nil
+	case *lua.LTable:
+		if n := vv.Len(); n > 0 {
+			values := []interface{}{}
+			for i := 1; i <= n; i++ {
+				e, err := c.fromLuaConfig(state, vv.RawGetInt(i), key)
+				if err != nil {
+					return nil, err
+				}
+				if e != nil {
+					values = append(values, e)
+				}
+			}
+			return values, nil
+		}
+
+		keys := []string{}
+		var ret error
+		vv.ForEach(func(k, _ lua.LValue) {
+			ks, ok := k.(lua.LString)
+			if !ok {
+				ret = fmt.Errorf("invalid key '%s' in '%s'. must be a string", k.String(), strings.Join(key, "."))
+				return
+			}
+			keys = append(keys, string(ks))
+		})
+		if ret != nil {
+			return nil, ret
+		}
+		// sort the keys to name the functions in the same order every time.
+		sort.Strings(keys)
+
+		values := map[string]interface{}{}
+		for _, k := range keys {
+			e, err := c.fromLuaConfig(state, vv.RawGetString(k), append(key[:len(key):len(key)], k))
+			if err != nil {
+				return nil, err
+			}
+			if e != nil {
+				values[k] = e
+			}
+		}
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values, nil
+	case *lua.LNilType:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("'%s' has an unsupported value '%s'", strings.Join(key, "."), v.Type())
+}
+
+// isHandlerCommandKey reports whether the key is a list of handlers, or 'command' of '[[handler]]', including the ones in the jobs.
+func isHandlerCommandKey(key []string) bool {
+	if len(key) > 2 && key[0] == "jobs" {
+		key = key[2:]
+	}
+	if len(key) == 1 {
+		return hasString(HandlerTypes, key[0])
+	}
+	return len(key) == 2 && key[0] == "handler" && key[1] == "command"
+}
+
+// luaFunction returns the Lua function of the handler command, or nil if it is not a Lua function.
+func (c *Config) luaFunction(command string) *luaFunction {
+	if !strings.HasPrefix(command, luaFunctionPrefix) {
+		return nil
+	}
+	return c.luaFunctions[command]
+}
+
+// call calls the function with the report table and the hook type.
+// The function fails if it raises an error, or returns false and an optional message.
+func (f *luaFunction) call(ctx context.Context, reportJSON []byte, handlerType string, out io.Writer) error {
+	var report interface{}
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		return err
+	}
+
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+
+	L := f.state.L
+	f.state.out = out
+	defer func() {
+		f.state.out = os.Stdout
+	}()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	if err := L.CallByParam(lua.P{Fn: f.fn, NRet: 2, Protect: true}, toLValue(L, report), lua.LString(handlerType)); err != nil {
+		return err
+	}
+	ret, msg := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if ret == lua.LFalse {
+		if msg == lua.LNil {
+			return errors.New("the function returned false")
+		}
+		return errors.New(msg.String())
+	}
+	return nil
+}
+
+// print writes the values to the output of the handler that is running.
+func (state *luaConfigState) print(L *lua.LState) int {
+	values := []string{}
+	for i := 1; i <= L.GetTop(); i++ {
+		values = append(values, L.ToStringMeta(L.Get(i)).String())
+	}
+	fmt.Fprintln(state.out, strings.Join(values, "\t"))
+	return 0
+}
+
+// luaConfigModuleLoader loads 'crun' module for Lua config files.
+func luaConfigModuleLoader(L *lua.LState) int {
+	hostname, _ := os.Hostname()
+	mod := L.NewTable()
+	mod.RawSetString("hostname", lua.LString(hostname))
+	mod.RawSetString("version", lua.LString(Version))
+	L.Push(mod)
+	return 1
+}
@@ -0,0 +1,110 @@
+package crun
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Show writes the effective settings in TOML format. If withOrigin is true, each setting has a comment where the value came from.
+func (c *Config) Show(w io.Writer, withOrigin bool) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(key string, v reflect.Value) bool {
+		if key == "jobs" {
+			return true
+		}
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			// unset optional values like the limits.
+			return true
+		}
+		if withOrigin {
+			fmt.Fprintf(tw, "%s = %s\t# %s\n", key, formatConfigValue(v), c.Origin(key))
+		} else {
+			fmt.Fprintf(tw, "%s = %s\n", key, formatConfigValue(v))
+		}
+		return true
+	})
+	return tw.Flush()
+}
+
+// formatConfigValue formats the value as a TOML value. A struct is formatted as an inline table that has the non-zero values.
+func formatConfigValue(v reflect.Value) string {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok && v.Kind() != reflect.Ptr {
+		// durations like '1h30m0s'.
+		if b, err := m.MarshalText(); err == nil {
+			return strconv.Quote(string(b))
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return `""`
+		}
+		return formatConfigValue(v.Elem())
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Slice:
+		values := []string{}
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, formatConfigValue(v.Index(i)))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case reflect.Map:
+		keys := []string{}
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		values := []string{}
+		for _, k := range keys {
+			values = append(values, fmt.Sprintf("%s = %s", formatConfigKey(k), formatConfigValue(v.MapIndex(reflect.ValueOf(k)))))
+		}
+		return "{" + strings.Join(values, ", ") + "}"
+	case reflect.Struct:
+		values := []string{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := t.Field(i).Tag.Get("toml")
+			fv := v.Field(i)
+			if tag == "" || tag == "-" || isZeroValue(fv) {
+				continue
+			}
+			values = append(values, fmt.Sprintf("%s = %s", tag, formatConfigValue(fv)))
+		}
+		return "{" + strings.Join(values, ", ") + "}"
+	}
+	return strconv.Quote(fmt.Sprintf("%v", v.Interface()))
+}
+
+// formatConfigKey quotes the key if it is not a bare key.
+func formatConfigKey(k string) string {
+	for _, r := range k {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return strconv.Quote(k)
+		}
+	}
+	if k == "" {
+		return `""`
+	}
+	return k
+}
+
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,296 @@
+package crun
+
+import (
+	"encoding"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The config files that are loaded automatically in this order.
+var (
+	SystemConfigFile   = "/etc/crun/crun.toml"
+	SystemConfigDir    = "/etc/crun/conf.d"
+	UserConfigFile     = "crun/crun.toml"
+	ProjectConfigFile  = ".crun.toml"
+	ConfigEnvPrefix    = "CRUN_CONFIG_"
+	OriginDefault      = "default"
+	originSeparator    = ", "
+	appendedConfigKeys = []string{"pre", "notice", "success", "failure", "post", "heartbeat", "environment", "handler"}
+)
+
+// jobLayer is a '[jobs.<name>]' table in a config file.
+type jobLayer struct {
+	primitive toml.Primitive
+	metadata  toml.MetaData
+	path      string
+}
+
+// ConfigFiles returns the config files that exist in the order to load:
+// the system config file, the drop-in files in the system config directory, the user config file and the project config file.
+func ConfigFiles() ([]string, error) {
+	candidates := []string{SystemConfigFile}
+
+	dropins, err := filepath.Glob(filepath.Join(SystemConfigDir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dropins)
+	candidates = append(candidates, dropins...)
+
+	if dir := userConfigDir(); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, UserConfigFile))
+	}
+	candidates = append(candidates, ProjectConfigFile)
+
+	files := []string{}
+	for _, path := range candidates {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if err := checkConfigFileOwner(path, fi); err != nil {
+			return nil, err
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// userConfigDir returns '$XDG_CONFIG_HOME' or '~/.config'.
+func userConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config")
+}
+
+// checkConfigFileOwner refuses a config file that others can modify, because handlers in it run as the user of crun (often root).
+func checkConfigFileOwner(path string, fi os.FileInfo) error {
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("refusing to load config file '%s': it is writable by group or others", path)
+	}
+	if uid, ok := fileOwner(fi); ok && uid != 0 && uid != os.Getuid() {
+		return fmt.Errorf("refusing to load config file '%s': it is owned by uid %d", path, uid)
+	}
+	return nil
+}
+
+func fileOwner(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
+
+// LoadConfigFile loads the config file over the current config. A file that has '.lua' extension is loaded as a Lua config file.
+// The values of the lists of handlers and 'environment' are appended to the current ones, and the other values override them.
+func (c *Config) LoadConfigFile(path string) error {
+	if filepath.Ext(path) == ".lua" {
+		return c.loadLuaConfigFile(path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.loadConfig(path, string(b))
+}
+
+// loadConfig loads the TOML data of the config file.
+func (c *Config) loadConfig(path, data string) error {
+	prevs := map[string]reflect.Value{}
+	for _, key := range appendedConfigKeys {
+		field := c.field(key)
+		prevs[key] = reflect.ValueOf(field.Interface())
+		// the decoder may reuse the backing array of the slice, so the previous values must be detached.
+		field.Set(reflect.Zero(field.Type()))
+	}
+	c.Jobs = nil
+
+	md, err := toml.Decode(data, c)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range appendedConfigKeys {
+		field := c.field(key)
+		if md.IsDefined(key) {
+			field.Set(reflect.AppendSlice(prevs[key], field))
+		} else {
+			field.Set(prevs[key])
+		}
+	}
+
+	for _, key := range md.Keys() {
+		k := key.String()
+		if len(key) > 1 && key[0] == "jobs" {
+			continue
+		}
+		if hasString(appendedConfigKeys, key[0]) {
+			if len(key) == 1 {
+				c.AppendOrigin(k, path)
+			}
+			continue
+		}
+		c.SetOrigin(k, path)
+	}
+
+	c.files = append(c.files, &loadedConfigFile{path: path, metadata: md})
+
+	for name, p := range c.Jobs {
+		c.jobLayers[name] = append(c.jobLayers[name], &jobLayer{primitive: p, metadata: md, path: path})
+	}
+	c.Jobs = nil
+
+	return nil
+}
+
+// ApplyEnv overrides the config with 'CRUN_CONFIG_<KEY>' environment variables like 'CRUN_CONFIG_TIMEOUT' and 'CRUN_CONFIG_LIMITS_NOFILE'.
+// The prefix is not 'CRUN_', because the handlers receive the result as 'CRUN_*' variables like 'CRUN_TAG'.
+// Only the settings that have a scalar value are supported.
+func (c *Config) ApplyEnv(environ []string) error {
+	env := map[string]string{}
+	for _, e := range environ {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], ConfigEnvPrefix) {
+			env[kv[0]] = kv[1]
+		}
+	}
+
+	var ret error
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(key string, v reflect.Value) bool {
+		name := ConfigEnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		value, ok := env[name]
+		if !ok {
+			return true
+		}
+		set, err := setScalar(v, value)
+		if err != nil {
+			ret = fmt.Errorf("invalid value of %s '%s': %v", name, value, err)
+			return false
+		}
+		if set {
+			c.SetOrigin(key, "env "+name)
+		}
+		return true
+	})
+	return ret
+}
+
+// setScalar sets the string value to the scalar. It returns false if the value is not a scalar.
+func setScalar(v reflect.Value, s string) (bool, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return false, nil
+		}
+		p := reflect.New(v.Type().Elem())
+		set, err := setScalar(p.Elem(), s)
+		if set && err == nil {
+			v.Set(p)
+		}
+		return set, err
+	}
+
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		// durations like '90s'.
+		return true, u.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return true, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return true, err
+		}
+		v.SetInt(i)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// SetOrigin records where the value of the key came from.
+func (c *Config) SetOrigin(key, origin string) {
+	c.origins[key] = origin
+}
+
+// AppendOrigin records another origin of the value of the key, whose values are appended like handlers.
+func (c *Config) AppendOrigin(key, origin string) {
+	if prev, ok := c.origins[key]; ok {
+		c.origins[key] = prev + originSeparator + origin
+		return
+	}
+	c.origins[key] = origin
+}
+
+// Origin returns where the value of the key came from.
+func (c *Config) Origin(key string) string {
+	if origin, ok := c.origins[key]; ok {
+		return origin
+	}
+	return OriginDefault
+}
+
+// field returns the field of the config that has the top-level key.
+func (c *Config) field(key string) reflect.Value {
+	var ret reflect.Value
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(k string, v reflect.Value) bool {
+		if k == key {
+			ret = v
+			return false
+		}
+		return true
+	})
+	return ret
+}
+
+// walkConfig calls fn with the dotted key and the value of each setting in the struct.
+// The settings in the tables like 'limits' are walked recursively. It stops when fn returns false.
+func walkConfig(v reflect.Value, prefix string, fn func(key string, v reflect.Value) bool) bool {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("toml")
+		if f.PkgPath != "" || tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + tag
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if !walkConfig(fv, key+".", fn) {
+				return false
+			}
+			continue
+		}
+		if !fn(key, fv) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package crun
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigLayers(t *testing.T) {
+	layers := []struct {
+		path string
+		data string
+	}{
+		{"/etc/crun/crun.toml", `
+timeout = 10
+tag = "system"
+pre = ["pre-system"]
+environment = ["A=1"]
+[limits]
+nofile = 1024
+`},
+		{"/etc/crun/conf.d/10-team.toml", `
+pre = ["pre-team"]
+`},
+		{".crun.toml", `
+timeout = "1m"
+environment = ["B=2"]
+[limits]
+nproc = 64
+`},
+	}
+
+	c := newConfig()
+	for _, l := range layers {
+		if err := c.loadConfig(l.path, l.data); err != nil {
+			t.Fatalf("failed to load %s: %v", l.path, err)
+		}
+	}
+
+	if c.Timeout != Duration(time.Minute) {
+		t.Errorf("timeout = %s, want 1m0s", c.Timeout)
+	}
+	if c.Tag != "system" {
+		t.Errorf("tag = %q, want %q", c.Tag, "system")
+	}
+	if want := []string{"pre-system", "pre-team"}; !reflect.DeepEqual(c.PreHandlers, want) {
+		t.Errorf("pre = %v, want %v", c.PreHandlers, want)
+	}
+	if want := []string{"A=1", "B=2"}; !reflect.DeepEqual(c.Environment, want) {
+		t.Errorf("environment = %v, want %v", c.Environment, want)
+	}
+	if c.Limits.Nofile == nil || *c.Limits.Nofile != 1024 {
+		t.Errorf("limits.nofile = %v, want 1024", c.Limits.Nofile)
+	}
+	if c.Limits.Nproc == nil || *c.Limits.Nproc != 64 {
+		t.Errorf("limits.nproc = %v, want 64", c.Limits.Nproc)
+	}
+
+	origins := []struct {
+		key  string
+		want string
+	}{
+		{"timeout", ".crun.toml"},
+		{"tag", "/etc/crun/crun.toml"},
+		{"pre", "/etc/crun/crun.toml, /etc/crun/conf.d/10-team.toml"},
+		{"environment", "/etc/crun/crun.toml, .crun.toml"},
+		{"limits.nofile", "/etc/crun/crun.toml"},
+		{"limits.nproc", ".crun.toml"},
+		{"log_file", OriginDefault},
+		{"post", OriginDefault},
+	}
+	for _, o := range origins {
+		if got := c.Origin(o.key); got != o.want {
+			t.Errorf("origin of %s = %q, want %q", o.key, got, o.want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cases := []struct {
+		name    string
+		environ []string
+		key     string
+		origin  string
+		check   func(c *Config) bool
+		wantErr bool
+	}{
+		{
+			name:    "string",
+			environ: []string{"CRUN_CONFIG_TAG=nightly"},
+			key:     "tag",
+			origin:  "env CRUN_CONFIG_TAG",
+			check:   func(c *Config) bool { return c.Tag == "nightly" },
+		},
+		{
+			name:    "bool",
+			environ: []string{"CRUN_CONFIG_QUIET=true"},
+			key:     "quiet",
+			origin:  "env CRUN_CONFIG_QUIET",
+			check:   func(c *Config) bool { return c.Quiet },
+		},
+		{
+			name:    "int",
+			environ: []string{"CRUN_CONFIG_HANDLER_RETRIES=3"},
+			key:     "handler_retries",
+			origin:  "env CRUN_CONFIG_HANDLER_RETRIES",
+			check:   func(c *Config) bool { return c.HandlerRetries == 3 },
+		},
+		{
+			name:    "duration",
+			environ: []string{"CRUN_CONFIG_TIMEOUT=90s"},
+			key:     "timeout",
+			origin:  "env CRUN_CONFIG_TIMEOUT",
+			check:   func(c *Config) bool { return c.Timeout == Duration(90*time.Second) },
+		},
+		{
+			name:    "duration in seconds",
+			environ: []string{"CRUN_CONFIG_TIMEOUT=1.5"},
+			key:     "timeout",
+			origin:  "env CRUN_CONFIG_TIMEOUT",
+			check:   func(c *Config) bool { return c.Timeout == Duration(1500*time.Millisecond) },
+		},
+		{
+			name:    "table",
+			environ: []string{"CRUN_CONFIG_LIMITS_NOFILE=4096"},
+			key:     "limits.nofile",
+			origin:  "env CRUN_CONFIG_LIMITS_NOFILE",
+			check:   func(c *Config) bool { return c.Limits.Nofile != nil && *c.Limits.Nofile == 4096 },
+		},
+		{
+			name:    "list is not supported",
+			environ: []string{"CRUN_CONFIG_PRE=echo"},
+			key:     "pre",
+			origin:  OriginDefault,
+			check:   func(c *Config) bool { return len(c.PreHandlers) == 0 },
+		},
+		{
+			name:    "other variables are ignored",
+			environ: []string{"CRUN_TAG=nightly", "TAG=nightly"},
+			key:     "tag",
+			origin:  OriginDefault,
+			check:   func(c *Config) bool { return c.Tag == "" },
+		},
+		{
+			name:    "invalid int",
+			environ: []string{"CRUN_CONFIG_HANDLER_RETRIES=three"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			environ: []string{"CRUN_CONFIG_TIMEOUT=soon"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConfig()
+			err := c.ApplyEnv(tc.environ)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.check(c) {
+				t.Errorf("%v was not applied", tc.environ)
+			}
+			if got := c.Origin(tc.key); got != tc.origin {
+				t.Errorf("origin of %s = %q, want %q", tc.key, got, tc.origin)
+			}
+		})
+	}
+}
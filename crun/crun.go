@@ -2,6 +2,7 @@ package crun
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
@@ -16,7 +17,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -28,6 +30,13 @@ type Crun struct {
 	StdoutWriter io.Writer
 	StderrWriter io.Writer
 	lockfile     *os.File
+	cgroup       *cgroup
+	reportMutex  sync.Mutex
+	rootSpan     *span
+	// jobCredentialErr is the error of looking up the job's user and group.
+	jobCredentialErr error
+	// heartbeatCtx is canceled when the command finishes, to stop the heartbeat handlers that are running.
+	heartbeatCtx context.Context
 }
 
 func New() *Crun {
@@ -61,6 +70,11 @@ func (c *Crun) Run() (*structs.Report, error) {
 		return r, err
 	}
 
+	// the ping, the metrics and the trace report the job to the external systems.
+	// they only output their errors, so a monitor that is down never changes the result of the job.
+	c.startTrace()
+	defer c.endTrace(r)
+
 	// create mutex directory
 	if _, err := os.Stat(c.Config.Mutexdir); os.IsNotExist(err) {
 		defaultUmask := syscall.Umask(0)
@@ -85,7 +99,7 @@ func (c *Crun) Run() (*structs.Report, error) {
 			return c.handleErrorBeforeRunning(r, err, nil)
 		}
 
-		f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		f, err := c.openLogFile(logfile)
 		if err != nil {
 			return c.handleErrorBeforeRunning(r, err, nil)
 		}
@@ -99,24 +113,40 @@ func (c *Crun) Run() (*structs.Report, error) {
 	}
 
 	if c.Config.WithoutOverlapping {
-		if err := c.lockForWithoutOverlapping(); err != nil {
+		lockSpan := c.rootSpan.child("lock")
+		err := c.lockForWithoutOverlapping()
+		lockSpan.finish(err)
+		if err != nil {
 			return c.handleErrorBeforeRunning(r, err, []string{"CRUN_OVERLAPPING=1"})
 		}
 		defer c.unlockForWithoutOverlapping()
 	}
 
-	cmd := exec.Command(c.CommandArgs[0], c.CommandArgs[1:]...)
-	cmd.Stdin = os.Stdin
-
-	if os.Getuid() == 0 {
-		uid, gid, err := c.getUidAndGid()
+	if c.Config.Cgroup.Enabled() {
+		cg, err := createCgroup(&c.Config.Cgroup)
 		if err != nil {
 			return c.handleErrorBeforeRunning(r, err, nil)
 		}
+		c.cgroup = cg
+		defer func() {
+			if err := cg.remove(); err != nil {
+				c.handleError(err)
+			}
+		}()
+	}
+
+	cred, err := lookupCredential(c.Config.User, c.Config.Group)
+	if err != nil {
+		c.jobCredentialErr = err
+		return c.handleErrorBeforeRunning(r, err, nil)
+	}
 
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
-		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	cmd, shimErrReader, err := c.newCommand(cred)
+	if err != nil {
+		return c.handleErrorBeforeRunning(r, err, nil)
 	}
+	cmd.Stdin = os.Stdin
+	cmd.Env = c.environ(cred)
 
 	if c.Config.WorkingDirectory != "" {
 		cmd.Dir = c.Config.WorkingDirectory
@@ -132,26 +162,43 @@ func (c *Crun) Run() (*structs.Report, error) {
 		return c.handleErrorBeforeRunning(r, err, nil)
 	}
 
-	var bufStdout bytes.Buffer
-	var bufStderr bytes.Buffer
-	var bufMerged bytes.Buffer
+	bufStdout := &syncBuffer{}
+	bufStderr := &syncBuffer{}
+	bufMerged := &syncBuffer{}
 
-	stdoutPipe2 := io.TeeReader(stdoutPipe, io.MultiWriter(&bufStdout, &bufMerged))
-	stderrPipe2 := io.TeeReader(stderrPipe, io.MultiWriter(&bufStderr, &bufMerged))
+	stdoutPipe2 := io.TeeReader(stdoutPipe, io.MultiWriter(bufStdout, bufMerged))
+	stderrPipe2 := io.TeeReader(stderrPipe, io.MultiWriter(bufStderr, bufMerged))
 
 	// run pre handlers
 	if err := c.runPreHandlers(r, nil); err != nil {
 		return c.handleErrorBeforeRunning(r, err, nil)
 	}
 
+	c.ping(pingStart, r)
+
+	// instrumented commands join the trace with 'TRACEPARENT' environment variable.
+	commandSpan := c.rootSpan.child("command")
+	if tp := commandSpan.traceparent(); tp != "" {
+		cmd.Env = setEnv(cmd.Env, "TRACEPARENT", tp)
+	}
+
 	r.StartAt = now()
 	if err := cmd.Start(); err != nil {
 		stderrPipe.Close()
 		stdoutPipe.Close()
+		commandSpan.finish(err)
+		return c.handleErrorBeforeRunning(r, err, nil)
+	}
+	if err := waitExecShim(cmd, shimErrReader); err != nil {
+		stderrPipe.Close()
+		stdoutPipe.Close()
+		cmd.Wait()
+		commandSpan.finish(err)
 		return c.handleErrorBeforeRunning(r, err, nil)
 	}
 	if cmd.Process != nil {
 		r.Pid = cmd.Process.Pid
+		commandSpan.setAttribute("process.pid", r.Pid)
 	}
 
 	// run notice handlers
@@ -160,6 +207,9 @@ func (c *Crun) Run() (*structs.Report, error) {
 		noticeHandlersDone <- c.runNoticeHandlers(r, nil)
 	}()
 
+	// run heartbeat handlers periodically
+	stopHeartbeat := c.startHeartbeat(r, bufMerged)
+
 	eg := &errgroup.Group{}
 	eg.Go(func() error {
 		defer stdoutPipe.Close()
@@ -184,14 +234,14 @@ func (c *Crun) Run() (*structs.Report, error) {
 		}()
 
 		select {
-		case <-time.After(time.Duration(c.Config.Timeout) * time.Second):
+		case <-time.After(c.Config.Timeout.Duration()):
 			if err := cmd.Process.Kill(); err != nil {
 				c.handleError(fmt.Errorf("failed to kill: " + err.Error()))
 			}
-			err = fmt.Errorf("crun terminated the command. it took time over %d sec", c.Config.Timeout)
+			err = fmt.Errorf("crun terminated the command. it took time over %s", c.Config.Timeout)
 			c.handleError(err)
 
-			envForHandler = append(envForHandler, fmt.Sprintf("CRUN_TIMEOUT=%d", c.Config.Timeout))
+			envForHandler = append(envForHandler, "CRUN_TIMEOUT="+c.Config.Timeout.Seconds())
 		case err = <-done:
 			defer close(done)
 		}
@@ -202,13 +252,24 @@ func (c *Crun) Run() (*structs.Report, error) {
 		err = cmd.Wait()
 	}
 
+	stopHeartbeat()
+
 	r.EndAt = now()
 	es := wrapcommander.ResolveExitStatus(err)
 	r.ExitCode = es.ExitCode()
 	r.Signaled = es.Signaled()
+	commandSpan.setAttribute("crun.exit_code", r.ExitCode)
+	commandSpan.finish(err)
+	if c.cgroup != nil {
+		r.Cgroup = c.cgroup.report()
+	}
 	r.Result = fmt.Sprintf("command exited with code: %d", r.ExitCode)
 	if r.Signaled {
-		r.Result = fmt.Sprintf("command died with signal: %d", r.ExitCode&127)
+		sig := syscall.Signal(r.ExitCode & 127)
+		r.Result = fmt.Sprintf("command died with signal: %d", sig)
+		c.resolveSignalReason(r, sig)
+	} else if r.Cgroup != nil && r.Cgroup.OomKill > 0 {
+		r.Reason = "a process of the command was killed by the OOM killer"
 	}
 	r.Stdout = bufStdout.String()
 	r.Stderr = bufStderr.String()
@@ -219,55 +280,53 @@ func (c *Crun) Run() (*structs.Report, error) {
 	}
 
 	if err != nil {
+		c.ping(pingFailure, r)
+		c.exportMetrics(r, false)
 		if err := c.runFailureHandlers(r, nil); err != nil {
 			c.handleError(err)
 		}
 	} else {
+		c.ping(pingSuccess, r)
+		c.exportMetrics(r, true)
 		if err := c.runSuccessHandlers(r, nil); err != nil {
 			c.handleError(err)
 		}
 	}
 
+	// wait for notice handlers, so that post handlers get their results.
+	if err := <-noticeHandlersDone; err != nil {
+		c.handleError(err)
+	}
+
 	// run post handlers
 	if err := c.runPostHandlers(r, nil); err != nil {
 		c.handleError(err)
 	}
 
-	<-noticeHandlersDone
 	return r, nil
 }
 
-func (c *Crun) getUidAndGid() (int, int, error) {
-	var uid, gid int
-	if c.Config.User != "" {
-		u, err := LookupUserStruct(c.Config.User)
-		if err != nil {
-			return -1, -1, err
-		}
-
-		uid, err = strconv.Atoi(u.Uid)
-		if err != nil {
-			return -1, -1, err
-		}
-
-		gid, err = strconv.Atoi(u.Gid)
-		if err != nil {
-			return -1, -1, err
-		}
-	} else {
-		uid = os.Getuid()
-		gid = os.Getgid()
+// resolveSignalReason explains why the command died with the signal, if crun knows it.
+func (c *Crun) resolveSignalReason(r *structs.Report, sig syscall.Signal) {
+	if sig == syscall.SIGKILL && r.Cgroup != nil && r.Cgroup.OomKill > 0 {
+		r.Result = "command was killed by the OOM killer"
+		r.Reason = fmt.Sprintf("out of memory (cgroup.memory_max = %s)", c.Config.Cgroup.MemoryMax)
+		return
 	}
 
-	if c.Config.Group != "" {
-		id, err := LookupGroup(c.Config.Group)
-		if err != nil {
-			return -1, -1, err
-		}
-		gid = id
+	if reason := c.Config.Limits.limitViolation(sig); reason != "" {
+		r.Result = fmt.Sprintf("command died with signal: %d (%s)", sig, sig)
+		r.Reason = reason
 	}
+}
 
-	return uid, gid, nil
+// environ returns the environment variables for a process that runs as the credential.
+func (c *Crun) environ(cred *credential) []string {
+	env := cred.environ(os.Environ())
+	for k, v := range c.Config.EnvironmentMap {
+		env = setEnv(env, k, v)
+	}
+	return env
 }
 
 func (c *Crun) handleError(err error) {
@@ -277,6 +336,8 @@ func (c *Crun) handleError(err error) {
 func (c *Crun) handleErrorBeforeRunning(r *structs.Report, err error, customEnv []string) (*structs.Report, error) {
 	r.ExitCode = -1
 	r.Result = err.Error()
+	c.ping(pingFailure, r)
+	c.exportMetrics(r, false)
 	if err := c.runFailureHandlers(r, customEnv); err != nil {
 		c.handleError(err)
 	}
@@ -287,51 +348,341 @@ func (c *Crun) handleErrorBeforeRunning(r *structs.Report, err error, customEnv
 	return r, err
 }
 
-func (c *Crun) runPreHandlers(r *structs.Report, customEnv []string) error {
+// reportJSON returns the report as JSON that is passed to handlers.
+func (c *Crun) reportJSON(r *structs.Report) []byte {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
 	b, _ := json.Marshal(r)
-	return c.runHandlers(c.Config.PreHandlers, b, "pre", customEnv)
+	return b
+}
+
+// recordHandlerReport adds the result of a handler to the report.
+func (c *Crun) recordHandlerReport(hr *structs.HandlerReport) {
+	if hr.Type == "heartbeat" {
+		// heartbeat handlers are not recorded, because they run many times.
+		return
+	}
+
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	c.Report.Handlers = append(c.Report.Handlers, hr)
+}
+
+func skippedHandlerReport(h *Handler, handlerType string) *structs.HandlerReport {
+	return &structs.HandlerReport{
+		Type:     handlerType,
+		Name:     h.name(),
+		Command:  h.Command,
+		ExitCode: -1,
+		Skipped:  true,
+	}
+}
+
+func (c *Crun) runPreHandlers(r *structs.Report, customEnv []string) error {
+	b := c.reportJSON(r)
+	return c.runHandlers(c.Config.handlers("pre"), b, "pre", customEnv)
 }
 
 func (c *Crun) runNoticeHandlers(r *structs.Report, customEnv []string) error {
-	b, _ := json.Marshal(r)
-	return c.runHandlers(c.Config.NoticeHandlers, b, "notice", customEnv)
+	b := c.reportJSON(r)
+	return c.runHandlers(c.Config.handlers("notice"), b, "notice", customEnv)
 }
 
 func (c *Crun) runPostHandlers(r *structs.Report, customEnv []string) error {
-	b, _ := json.Marshal(r)
-	return c.runHandlers(c.Config.PostHandlers, b, "post", customEnv)
+	b := c.reportJSON(r)
+	return c.runHandlers(c.Config.handlers("post"), b, "post", customEnv)
 }
 
 func (c *Crun) runSuccessHandlers(r *structs.Report, customEnv []string) error {
-	b, _ := json.Marshal(r)
-	return c.runHandlers(c.Config.SuccessHandlers, b, "success", customEnv)
+	b := c.reportJSON(r)
+	return c.runHandlers(c.Config.handlers("success"), b, "success", customEnv)
 }
 
 func (c *Crun) runFailureHandlers(r *structs.Report, customEnv []string) error {
-	b, _ := json.Marshal(r)
-	return c.runHandlers(c.Config.FailureHandlers, b, "failure", customEnv)
+	b := c.reportJSON(r)
+	return c.runHandlers(c.Config.handlers("failure"), b, "failure", customEnv)
+}
+
+// matchedHandlers returns the handlers whose conditions are satisfied by the report.
+func (c *Crun) matchedHandlers(handlers []*Handler, json []byte, handlerType string) []*Handler {
+	ret := []*Handler{}
+	for _, h := range handlers {
+		if h.When != nil {
+			matched, err := h.When.match(json)
+			if err != nil {
+				c.handleError(fmt.Errorf("%s handler %q: %v", handlerType, h.label(), err))
+				continue
+			}
+			if !matched {
+				continue
+			}
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+func (c *Crun) runHeartbeatHandlers(r *structs.Report, customEnv []string) error {
+	b := c.reportJSON(r)
+	return c.runHandlers(c.Config.handlers("heartbeat"), b, "heartbeat", customEnv)
 }
 
-func (c *Crun) runHandlers(handlers []string, json []byte, handlerType string, customEnv []string) error {
+// startHeartbeat runs heartbeat handlers every 'heartbeat_interval' while the command runs.
+// It returns the function to stop it.
+func (c *Crun) startHeartbeat(r *structs.Report, output *syncBuffer) func() {
+	if c.Config.HeartbeatInterval <= 0 || len(c.Config.handlers("heartbeat")) == 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.heartbeatCtx = ctx
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(c.Config.HeartbeatInterval.Duration())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// the error of the handlers that are stopped by the end of the command is not reported.
+				if err := c.runHeartbeatHandlers(c.heartbeatSnapshot(r, output), nil); err != nil && ctx.Err() == nil {
+					c.handleError(err)
+				}
+			}
+		}
+	}()
+
+	// the heartbeat handlers that are running are stopped, so that they never delay the result of the job.
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// handlerContext returns the context that the handlers of the type run with.
+func (c *Crun) handlerContext(handlerType string) context.Context {
+	if handlerType == "heartbeat" && c.heartbeatCtx != nil {
+		return c.heartbeatCtx
+	}
+	return context.Background()
+}
+
+// heartbeatSnapshot returns a snapshot of the report while the command runs.
+// It has the tail of the output so far and the elapsed time.
+func (c *Crun) heartbeatSnapshot(r *structs.Report, output *syncBuffer) *structs.Report {
+	c.reportMutex.Lock()
+	snapshot := *r
+	c.reportMutex.Unlock()
+
+	snapshot.Output = tail(output.String(), outputTailSize)
+	if snapshot.StartAt != nil {
+		snapshot.Elapsed = time.Since(*snapshot.StartAt).Seconds()
+	}
+	return &snapshot
+}
+
+func (c *Crun) runHandlers(handlers []*Handler, json []byte, handlerType string, customEnv []string) error {
+	handlers = c.matchedHandlers(handlers, json, handlerType)
+
+	// heartbeat handlers are not traced, because they run many times.
+	var phaseSpan *span
+	if handlerType != "heartbeat" && len(handlers) > 0 {
+		phaseSpan = c.rootSpan.child(handlerType + " handlers")
+	}
+	err := c.runMatchedHandlers(handlers, json, handlerType, customEnv, phaseSpan)
+	phaseSpan.finish(err)
+	return err
+}
+
+func (c *Crun) runMatchedHandlers(handlers []*Handler, json []byte, handlerType string, customEnv []string, phaseSpan *span) error {
+	if c.Config.handlerMode(handlerType) == HandlerModeSequential {
+		var ret error
+		stopped := false
+		for _, h := range handlers {
+			if stopped {
+				c.recordHandlerReport(skippedHandlerReport(h, handlerType))
+				continue
+			}
+			failed, err := c.runHandlerWithPolicy(h, json, handlerType, customEnv, phaseSpan)
+			if err != nil && ret == nil {
+				ret = err
+			}
+			if failed && h.StopOnError {
+				stopped = true
+			}
+		}
+		return ret
+	}
+
+	var sem chan struct{}
+	if c.Config.MaxParallelHandlers > 0 {
+		sem = make(chan struct{}, c.Config.MaxParallelHandlers)
+	}
+	var stopped int32
+
 	eg := &errgroup.Group{}
 	for _, handler := range handlers {
 		h := handler
+		// acquire the semaphore here, so that the handlers start in the defined order.
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		eg.Go(func() error {
-			return c.runHandler(h, json, handlerType, customEnv)
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			// handlers that have not started yet are skipped after a 'stop_on_error' handler failed.
+			if atomic.LoadInt32(&stopped) == 1 {
+				c.recordHandlerReport(skippedHandlerReport(h, handlerType))
+				return nil
+			}
+
+			failed, err := c.runHandlerWithPolicy(h, json, handlerType, customEnv, phaseSpan)
+			if failed && h.StopOnError {
+				atomic.StoreInt32(&stopped, 1)
+			}
+			return err
 		})
 	}
 	return eg.Wait()
 }
 
-func (c *Crun) runHandler(cmdStr string, json []byte, handlerType string, customEnv []string) error {
-	args, err := shellquote.Split(cmdStr)
-	if err != nil || len(args) < 1 {
-		return fmt.Errorf("invalid handler: %q", cmdStr)
+// runHandlerWithPolicy runs the handler and applies the failure policy.
+// It returns whether the handler failed, and the error that should be returned to the caller.
+func (c *Crun) runHandlerWithPolicy(h *Handler, json []byte, handlerType string, customEnv []string, phaseSpan *span) (bool, error) {
+	err := c.runHandler(h, json, handlerType, customEnv, phaseSpan)
+	if err == nil {
+		return false, nil
+	}
+	if c.handlerContext(handlerType).Err() != nil {
+		// the handler is stopped, because the command finished.
+		return false, nil
+	}
+
+	switch c.Config.handlerFailure(h, handlerType) {
+	case HandlerFailureIgnore:
+		return true, nil
+	case HandlerFailureWarn:
+		c.handleError(err)
+		return true, nil
+	}
+	return true, err
+}
+
+// runHandler runs the handler, and retries it when it fails. The result is recorded in the report.
+// Each attempt is traced as a child span of phaseSpan.
+func (c *Crun) runHandler(h *Handler, json []byte, handlerType string, customEnv []string, phaseSpan *span) error {
+	hr := &structs.HandlerReport{
+		Type:    handlerType,
+		Name:    h.name(),
+		Command: h.Command,
+	}
+	defer c.recordHandlerReport(hr)
+
+	start := time.Now()
+	var err error
+	for i := 0; i <= c.Config.handlerRetries(h); i++ {
+		if i > 0 {
+			if c.handlerContext(handlerType).Err() != nil {
+				break
+			}
+			time.Sleep(handlerRetryInterval)
+		}
+		hr.Attempts++
+
+		attemptSpan := phaseSpan.child("handler " + h.name())
+		env := customEnv
+		if tp := attemptSpan.traceparent(); tp != "" {
+			env = append(append([]string{}, customEnv...), "TRACEPARENT="+tp)
+		}
+		err = c.execHandler(h, json, handlerType, env, hr)
+		attemptSpan.setAttribute("crun.handler.type", handlerType)
+		attemptSpan.setAttribute("crun.handler.name", h.name())
+		attemptSpan.setAttribute("crun.handler.command", h.Command)
+		attemptSpan.setAttribute("crun.handler.attempt", hr.Attempts)
+		attemptSpan.setAttribute("crun.handler.exit_code", hr.ExitCode)
+		attemptSpan.finish(err)
+		if err == nil {
+			break
+		}
+	}
+	hr.DurationSeconds = float64(time.Since(start)) / float64(time.Second)
+	if err == nil {
+		return nil
+	}
+
+	hr.Error = err.Error()
+	name := h.label()
+	if h.Name != "" {
+		name = h.Name
+	}
+	return fmt.Errorf("%s handler %q failed: %v", handlerType, name, err)
+}
+
+// execHandler executes the handler once. The exit code and the output are set to the handler report.
+func (c *Crun) execHandler(h *Handler, json []byte, handlerType string, customEnv []string, hr *structs.HandlerReport) error {
+	hr.ExitCode = -1
+	hr.Output = ""
+
+	if fn := c.Config.luaFunction(h.Command); fn != nil {
+		return c.execLuaFunctionHandler(fn, h, json, handlerType, hr)
+	}
+	if h.luaScript {
+		return c.execLuaScriptHandler(h, json, handlerType, hr)
+	}
+	if h.Type != "" {
+		return c.execBuiltinHandler(h, json, handlerType, hr)
+	}
+
+	args, err := h.args(json, handlerType)
+	if err != nil {
+		return err
+	}
+
+	stdin, inputEnv, err := h.input(json, handlerType)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.handlerContext(handlerType)
+	timeout := c.Config.handlerTimeout(h)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout.Duration())
+		defer cancel()
 	}
 
+	cmd := exec.Command(args[0], args[1:]...)
+
+	cred, err := lookupCredential(c.handlerCredential(h))
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if cred.switches() {
+		cmd.SysProcAttr = cred.sysProcAttr()
+	}
+	// run the handler in its own process group, so that the timeout kills the processes that the handler started.
+	// otherwise they keep the output pipes open and the handler does not finish.
+	cmd.SysProcAttr.Setpgid = true
+
 	// set handler type to environment
-	env := os.Environ()
+	env := c.environ(cred)
 	env = append(env, "CRUN_HANDLER_TYPE="+handlerType)
+	if c.Config.LuaPath != "" {
+		// handlers that run 'crun --lua' load the modules from the same path.
+		env = append(env, LuaPathEnv+"="+c.Config.LuaPath)
+	}
+	if c.Config.LuaSandbox.Enabled {
+		// handlers that run 'crun --lua' run the script in the same sandbox.
+		env = append(env, c.Config.LuaSandbox.env())
+	}
+	env = append(env, inputEnv...)
 
 	if customEnv != nil {
 		for _, ce := range customEnv {
@@ -339,20 +690,83 @@ func (c *Crun) runHandler(cmdStr string, json []byte, handlerType string, custom
 		}
 	}
 
-	cmd := exec.Command(args[0], args[1:]...)
-	stdinPipe, _ := cmd.StdinPipe()
-	cmd.Stdout = c.StdoutWriter
-	cmd.Stderr = c.StderrWriter
+	prefix := "[" + h.name() + "] "
+	stdout := newPrefixWriter(c.StdoutWriter, prefix)
+	stderr := newPrefixWriter(c.StderrWriter, prefix)
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	output := &syncBuffer{}
+	defer func() {
+		hr.Output = output.String()
+	}()
+
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = io.MultiWriter(stdout, output)
+	cmd.Stderr = io.MultiWriter(stderr, output)
 	cmd.Env = env
 
 	if err := cmd.Start(); err != nil {
-		stdinPipe.Close()
 		return err
 	}
-	stdinPipe.Write(json)
-	stdinPipe.Close()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if cmd.ProcessState != nil {
+		hr.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("it took time over %s", timeout)
+	}
+	return err
+}
 
-	return cmd.Wait()
+// handlerCredential returns the user and the group that the handler runs as. If the job's user can not be looked up,
+// the handlers that inherit it run as crun itself, so that they can report the error.
+func (c *Crun) handlerCredential(h *Handler) (string, string) {
+	user, group := c.Config.handlerCredential(h)
+	if c.jobCredentialErr != nil && user == c.Config.User && group == c.Config.Group {
+		return "", ""
+	}
+	return user, group
+}
+
+// execLuaFunctionHandler calls the handler that is a Lua function in the crun process.
+func (c *Crun) execLuaFunctionHandler(fn *luaFunction, h *Handler, json []byte, handlerType string, hr *structs.HandlerReport) error {
+	ctx := c.handlerContext(handlerType)
+	timeout := c.Config.handlerTimeout(h)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout.Duration())
+		defer cancel()
+	}
+
+	stdout := newPrefixWriter(c.StdoutWriter, "["+h.name()+"] ")
+	defer stdout.Flush()
+
+	output := &syncBuffer{}
+	defer func() {
+		hr.Output = output.String()
+	}()
+
+	err := fn.call(ctx, json, handlerType, io.MultiWriter(stdout, output))
+	if ctx.Err() == context.DeadlineExceeded {
+		hr.ExitCode = 1
+		return fmt.Errorf("it took time over %s", timeout)
+	}
+	if err != nil {
+		hr.ExitCode = 1
+		return err
+	}
+	hr.ExitCode = 0
+	return nil
 }
 
 func (c *Crun) lockForWithoutOverlapping() error {
@@ -385,11 +799,19 @@ func (c *Crun) overlappingMutexFile() string {
 }
 
 func (c *Crun) overlappingMutexName() string {
-	mutex := c.Config.Mutex
-	if mutex == "" {
-		mutex = fmt.Sprintf("%x", sha1.Sum([]byte(c.Command())))
+	return fmt.Sprintf("crun-mutex-%s", c.mutexID())
+}
+
+// mutexID returns the id of the job. The default is the hash of the command.
+func (c *Crun) mutexID() string {
+	if c.Config.Mutex != "" {
+		return c.Config.Mutex
 	}
-	return fmt.Sprintf("crun-mutex-%s", mutex)
+	return commandHash(c.Command())
+}
+
+func commandHash(command string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(command)))
 }
 
 func (c *Crun) Command() string {
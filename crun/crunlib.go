@@ -0,0 +1,383 @@
+package crun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LuaPathEnv is the environment variable of the Lua module search path. It is the same as 'lua_path' in the config.
+const LuaPathEnv = "CRUN_LUA_PATH"
+
+// The defaults of 'crunlib.post'.
+var (
+	crunlibPostRetries  = 2
+	crunlibPostInterval = 1 * time.Second
+	crunlibPostTimeout  = 10 * time.Second
+)
+
+// setLuaPath prepends the search path to 'package.path'.
+// The path is a list of directories or Lua path templates like '/path/to/?.lua' separated by ';'.
+func setLuaPath(L *lua.LState, path string) {
+	if path == "" {
+		return
+	}
+	pkg, ok := L.GetGlobal("package").(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	templates := []string{}
+	for _, p := range strings.Split(path, ";") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if strings.Contains(p, "?") {
+			templates = append(templates, p)
+		} else {
+			templates = append(templates, filepath.Join(p, "?.lua"), filepath.Join(p, "?", "init.lua"))
+		}
+	}
+	if current := lua.LVAsString(pkg.RawGetString("path")); current != "" {
+		templates = append(templates, current)
+	}
+	pkg.RawSetString("path", lua.LString(strings.Join(templates, ";")))
+}
+
+// crunlibLoader loads 'crunlib' module that has the helpers to write handlers. 'report' reads the result from stdin.
+func crunlibLoader(L *lua.LState) int {
+	return openCrunlib(L, crunlibReadReport)
+}
+
+// preloadCrunlibReport replaces 'crunlib' module with the one whose 'report' returns the report instead of reading stdin.
+// Lua handlers use it, because their stdin is not the result.
+// It does nothing if the module is not preloaded, like in the sandbox that does not allow it.
+func preloadCrunlibReport(L *lua.LState, report interface{}) {
+	pkg, ok := L.GetGlobal("package").(*lua.LTable)
+	if !ok {
+		return
+	}
+	preload, ok := pkg.RawGetString("preload").(*lua.LTable)
+	if !ok || preload.RawGetString("crunlib") == lua.LNil {
+		return
+	}
+	L.PreloadModule("crunlib", func(L *lua.LState) int {
+		return openCrunlib(L, func(L *lua.LState) int {
+			L.Push(toLValue(L, report))
+			return 1
+		})
+	})
+}
+
+func openCrunlib(L *lua.LState, report lua.LGFunction) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"parse_args":  crunlibParseArgs,
+		"report":      report,
+		"read_report": report,
+		"render":      crunlibRender,
+		"post":        crunlibPost,
+		"split_csv":   crunlibSplitCSV,
+		"contains":    crunlibContains,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// crunlibParseArgs parses the arguments like '--a=one --b two -c three --flag rest'.
+// An option that has no value is true. It returns the table of the options and the list of the other arguments.
+// The default of the arguments is the global 'arg' without the script name.
+//
+//	local options, args = crunlib.parse_args()
+func crunlibParseArgs(L *lua.LState) int {
+	args := []string{}
+	if tb, ok := L.Get(1).(*lua.LTable); ok {
+		tb.ForEach(func(k, v lua.LValue) {
+			if n, ok := k.(lua.LNumber); ok && n >= 1 {
+				args = append(args, v.String())
+			}
+		})
+	} else if tb, ok := L.GetGlobal("arg").(*lua.LTable); ok {
+		for i := 1; i <= tb.Len(); i++ {
+			args = append(args, tb.RawGetInt(i).String())
+		}
+	}
+
+	options := L.NewTable()
+	rest := L.NewTable()
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			for _, r := range args[i+1:] {
+				rest.Append(lua.LString(r))
+			}
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			rest.Append(lua.LString(a))
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			options.RawSetString(name[:j], lua.LString(name[j+1:]))
+			continue
+		}
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			options.RawSetString(name, lua.LString(args[i+1]))
+			i++
+			continue
+		}
+		options.RawSetString(name, lua.LTrue)
+	}
+
+	L.Push(options)
+	L.Push(rest)
+	return 2
+}
+
+// crunlibReadReport reads the result JSON from stdin and returns it as a table.
+//
+//	local report, err = crunlib.report()
+func crunlibReadReport(L *lua.LState) int {
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	var report interface{}
+	if err := json.Unmarshal(b, &report); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to decode the report: %v", err)))
+		return 2
+	}
+	L.Push(toLValue(L, report))
+	return 1
+}
+
+// crunlibRender renders the Go template with the table.
+//
+//	local text, err = crunlib.render("{{.tag}} exited with {{.exitCode}}", report)
+func crunlibRender(L *lua.LState) int {
+	text := L.CheckString(1)
+	data, err := fromLValue(L.Get(2))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	tmpl, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(b.String()))
+	return 1
+}
+
+// crunlibPost posts the body to the URL, and retries if the request fails or the status is 5xx.
+// A table body is sent as JSON. The options are 'headers', 'retries' (default: 2), 'interval' and 'timeout' in seconds (default: 1 and 10).
+// It returns the response that has 'status' and 'body', and an error if the status is not 2xx.
+//
+//	local resp, err = crunlib.post(url, {text = "hello"}, {retries = 3})
+func crunlibPost(L *lua.LState) int {
+	url := L.CheckString(1)
+	opts := L.OptTable(3, L.NewTable())
+
+	var body []byte
+	contentType := "text/plain; charset=utf-8"
+	switch v := L.Get(2).(type) {
+	case *lua.LTable:
+		data, err := fromLValue(v)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		body = b
+		contentType = "application/json"
+	case *lua.LNilType:
+	default:
+		body = []byte(v.String())
+	}
+
+	retries := crunlibPostRetries
+	if v, ok := opts.RawGetString("retries").(lua.LNumber); ok {
+		retries = int(v)
+	}
+	interval := crunlibPostInterval
+	if v, ok := opts.RawGetString("interval").(lua.LNumber); ok {
+		interval = time.Duration(float64(v) * float64(time.Second))
+	}
+	timeout := crunlibPostTimeout
+	if v, ok := opts.RawGetString("timeout").(lua.LNumber); ok {
+		timeout = time.Duration(float64(v) * float64(time.Second))
+	}
+	headers := map[string]string{"Content-Type": contentType}
+	if tb, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+		tb.ForEach(func(k, v lua.LValue) {
+			headers[k.String()] = v.String()
+		})
+	}
+
+	ctx := L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var status int
+	var respBody []byte
+	var err error
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+		}
+		status, respBody, err = httpPost(ctx, url, body, headers, timeout)
+		if err == nil && status < 500 {
+			break
+		}
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	resp := L.NewTable()
+	resp.RawSetString("status", lua.LNumber(status))
+	resp.RawSetString("body", lua.LString(string(respBody)))
+	L.Push(resp)
+	if status < 200 || status >= 300 {
+		L.Push(lua.LString(fmt.Sprintf("unexpected status: %d", status)))
+		return 2
+	}
+	return 1
+}
+
+func httpPost(ctx context.Context, url string, body []byte, headers map[string]string, timeout time.Duration) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, b, nil
+}
+
+// crunlibSplitCSV splits the comma-separated values.
+//
+//	local items = crunlib.split_csv("Stdout,ExitCode")
+func crunlibSplitCSV(L *lua.LState) int {
+	tb := L.NewTable()
+	if s := L.CheckString(1); s != "" {
+		for _, v := range strings.Split(s, ",") {
+			tb.Append(lua.LString(strings.TrimSpace(v)))
+		}
+	}
+	L.Push(tb)
+	return 1
+}
+
+// crunlibContains reports whether the list has the value.
+//
+//	if crunlib.contains(items, "all") then ... end
+func crunlibContains(L *lua.LState) int {
+	tb := L.CheckTable(1)
+	v := L.Get(2)
+	for i := 1; i <= tb.Len(); i++ {
+		if tb.RawGetInt(i) == v {
+			L.Push(lua.LTrue)
+			return 1
+		}
+	}
+	L.Push(lua.LFalse)
+	return 1
+}
+
+// fromLValue converts a Lua value to a Go value. A table is a slice if it is an array, otherwise a map.
+// It returns an error if a table contains itself, because the value can not be converted.
+func fromLValue(v lua.LValue) (interface{}, error) {
+	return fromLValueVisiting(v, map[*lua.LTable]bool{})
+}
+
+// fromLValueVisiting converts the value. visiting has the tables that are being converted on the path to the value.
+func fromLValueVisiting(v lua.LValue, visiting map[*lua.LTable]bool) (interface{}, error) {
+	switch vv := v.(type) {
+	case lua.LBool:
+		return bool(vv), nil
+	case lua.LString:
+		return string(vv), nil
+	case lua.LNumber:
+		return float64(vv), nil
+	case *lua.LTable:
+		if visiting[vv] {
+			return nil, errors.New("the table has a circular reference")
+		}
+		visiting[vv] = true
+		defer delete(visiting, vv)
+
+		if n := vv.Len(); n > 0 {
+			values := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				e, err := fromLValueVisiting(vv.RawGetInt(i), visiting)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, e)
+			}
+			return values, nil
+		}
+		values := map[string]interface{}{}
+		var err error
+		vv.ForEach(func(k, e lua.LValue) {
+			if err != nil {
+				return
+			}
+			values[k.String()], err = fromLValueVisiting(e, visiting)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	return nil, nil
+}
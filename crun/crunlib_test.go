@@ -0,0 +1,136 @@
+package crun
+
+import (
+	"github.com/yuin/gopher-lua"
+	"reflect"
+	"testing"
+)
+
+func TestCrunlibParseArgs(t *testing.T) {
+	cases := []struct {
+		name    string
+		args    string
+		options map[string]interface{}
+		rest    []string
+	}{
+		{
+			name:    "empty",
+			args:    `{}`,
+			options: map[string]interface{}{},
+			rest:    []string{},
+		},
+		{
+			name:    "values",
+			args:    `{"--a=one", "--b", "two", "-c", "three"}`,
+			options: map[string]interface{}{"a": "one", "b": "two", "c": "three"},
+			rest:    []string{},
+		},
+		{
+			name:    "flags",
+			args:    `{"--flag", "--verbose", "--name=x"}`,
+			options: map[string]interface{}{"flag": true, "verbose": true, "name": "x"},
+			rest:    []string{},
+		},
+		{
+			name:    "rest",
+			args:    `{"first", "--flag", "-", "--a=1", "last"}`,
+			options: map[string]interface{}{"flag": true, "a": "1"},
+			rest:    []string{"first", "-", "last"},
+		},
+		{
+			name:    "after double dash",
+			args:    `{"--a", "1", "--", "--b", "c"}`,
+			options: map[string]interface{}{"a": "1"},
+			rest:    []string{"--b", "c"},
+		},
+		{
+			name:    "empty value",
+			args:    `{"--a="}`,
+			options: map[string]interface{}{"a": ""},
+			rest:    []string{},
+		},
+		{
+			name:    "default is arg",
+			args:    ``,
+			options: map[string]interface{}{"dry-run": true},
+			rest:    []string{"target"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			L := lua.NewState()
+			defer L.Close()
+			L.PreloadModule("crunlib", crunlibLoader)
+
+			arg := L.NewTable()
+			for i, v := range []string{"script.lua", "target", "--dry-run"} {
+				L.RawSet(arg, lua.LNumber(i), lua.LString(v))
+			}
+			L.SetGlobal("arg", arg)
+
+			if err := L.DoString(`options, rest = require("crunlib").parse_args(` + tc.args + `)`); err != nil {
+				t.Fatal(err)
+			}
+
+			options, err := fromLValue(L.GetGlobal("options"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(options, tc.options) {
+				t.Errorf("options = %#v, want %#v", options, tc.options)
+			}
+
+			rest := []string{}
+			tb := L.GetGlobal("rest").(*lua.LTable)
+			for i := 1; i <= tb.Len(); i++ {
+				rest = append(rest, tb.RawGetInt(i).String())
+			}
+			if !reflect.DeepEqual(rest, tc.rest) {
+				t.Errorf("rest = %#v, want %#v", rest, tc.rest)
+			}
+		})
+	}
+}
+
+func TestFromLValue(t *testing.T) {
+	cases := []struct {
+		name    string
+		code    string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "string", code: `v = "a"`, want: "a"},
+		{name: "number", code: `v = 1.5`, want: 1.5},
+		{name: "bool", code: `v = true`, want: true},
+		{name: "nil", code: `v = nil`, want: nil},
+		{name: "list", code: `v = {"a", 1}`, want: []interface{}{"a", float64(1)}},
+		{name: "map", code: `v = {a = {b = "c"}}`, want: map[string]interface{}{"a": map[string]interface{}{"b": "c"}}},
+		{name: "shared table", code: `local t = {"x"}; v = {a = t, b = t}`, want: map[string]interface{}{"a": []interface{}{"x"}, "b": []interface{}{"x"}}},
+		{name: "circular reference", code: `v = {}; v.self = v`, wantErr: true},
+		{name: "nested circular reference", code: `v = {a = {}}; v.a.parent = v`, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			L := lua.NewState()
+			defer L.Close()
+			if err := L.DoString(tc.code); err != nil {
+				t.Fatal(err)
+			}
+			got, err := fromLValue(L.GetGlobal("v"))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("fromLValue = %#v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("fromLValue = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package crun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time-related setting.
+// In the config, it is a number of seconds like 90, or a duration string like "90s" and "1h30m".
+type Duration time.Duration
+
+// ParseDuration parses a number of seconds or a Go duration string.
+func ParseDuration(s string) (Duration, error) {
+	s = strings.TrimSpace(s)
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		return Duration(sec * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s'. must be a number of seconds or a duration like '90s' and '1h30m'", s)
+	}
+	return Duration(d), nil
+}
+
+func (d *Duration) UnmarshalTOML(v interface{}) error {
+	switch vv := v.(type) {
+	case int64:
+		*d = Duration(time.Duration(vv) * time.Second)
+	case float64:
+		*d = Duration(vv * float64(time.Second))
+	case string:
+		parsed, err := ParseDuration(vv)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+	default:
+		return fmt.Errorf("invalid duration '%v'. must be a number of seconds or a duration like '90s' and '1h30m'", v)
+	}
+	return nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Set implements flag.Value, so the options accept a duration string too.
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Duration returns the value as time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// Seconds returns the value in seconds like "10" and "1.5".
+func (d Duration) Seconds() string {
+	return strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64)
+}
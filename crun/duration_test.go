@@ -0,0 +1,93 @@
+package crun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    Duration
+		wantErr bool
+	}{
+		{in: "90", want: Duration(90 * time.Second)},
+		{in: "1.5", want: Duration(1500 * time.Millisecond)},
+		{in: "0", want: 0},
+		{in: " 10 ", want: Duration(10 * time.Second)},
+		{in: "90s", want: Duration(90 * time.Second)},
+		{in: "1h30m", want: Duration(90 * time.Minute)},
+		{in: "250ms", want: Duration(250 * time.Millisecond)},
+		{in: "-5s", want: Duration(-5 * time.Second)},
+		{in: "", wantErr: true},
+		{in: "soon", wantErr: true},
+		{in: "10 minutes", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		got, err := ParseDuration(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseDuration(%q) = %s, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDuration(%q) returned an error: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseDuration(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDurationUnmarshalTOML(t *testing.T) {
+	cases := []struct {
+		in      interface{}
+		want    Duration
+		wantErr bool
+	}{
+		{in: int64(30), want: Duration(30 * time.Second)},
+		{in: float64(0.5), want: Duration(500 * time.Millisecond)},
+		{in: "2m", want: Duration(2 * time.Minute)},
+		{in: "45", want: Duration(45 * time.Second)},
+		{in: "soon", wantErr: true},
+		{in: true, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		var d Duration
+		err := d.UnmarshalTOML(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("UnmarshalTOML(%#v) = %s, want an error", tc.in, d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("UnmarshalTOML(%#v) returned an error: %v", tc.in, err)
+			continue
+		}
+		if d != tc.want {
+			t.Errorf("UnmarshalTOML(%#v) = %s, want %s", tc.in, d, tc.want)
+		}
+	}
+}
+
+func TestDurationSeconds(t *testing.T) {
+	cases := []struct {
+		in   Duration
+		want string
+	}{
+		{Duration(10 * time.Second), "10"},
+		{Duration(1500 * time.Millisecond), "1.5"},
+		{0, "0"},
+	}
+
+	for _, tc := range cases {
+		if got := tc.in.Seconds(); got != tc.want {
+			t.Errorf("Duration(%s).Seconds() = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
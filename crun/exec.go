@@ -0,0 +1,187 @@
+package crun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// execSpec is a set of process attributes that can not be set by os/exec.
+// They are applied by crun itself (the exec shim) right before exec'ing the command.
+type execSpec struct {
+	Rlimits     []rlimit    `json:"rlimits,omitempty"`
+	Cgroup      string      `json:"cgroup,omitempty"`
+	Nice        int         `json:"nice,omitempty"`
+	IOPriority  *ioPriority `json:"ioPriority,omitempty"`
+	CPUAffinity []int       `json:"cpuAffinity,omitempty"`
+	// Credential is the user and the groups that the shim switches to after it applies the other attributes,
+	// because they need the privileges of crun.
+	Credential *credential `json:"credential,omitempty"`
+}
+
+func (s *execSpec) empty() bool {
+	return len(s.Rlimits) == 0 && s.Cgroup == "" && s.Nice == 0 && s.IOPriority == nil && len(s.CPUAffinity) == 0
+}
+
+// execShimErrorFd is the file descriptor that the exec shim reports an error to the parent crun process.
+const execShimErrorFd = 3
+
+func (c *Crun) execSpec() *execSpec {
+	spec := &execSpec{
+		Rlimits:     c.Config.Limits.rlimits(),
+		Nice:        c.Config.Nice,
+		IOPriority:  c.Config.ioPriority(),
+		CPUAffinity: c.Config.CpuAffinity,
+	}
+	if c.cgroup != nil {
+		spec.Cgroup = c.cgroup.path
+	}
+	return spec
+}
+
+// newCommand creates a command to execute as the credential. If the command needs process attributes
+// that os/exec does not support, the command is executed through the exec shim, and the shim switches the credential.
+func (c *Crun) newCommand(cred *credential) (*exec.Cmd, *os.File, error) {
+	spec := c.execSpec()
+	if spec.empty() {
+		cmd := exec.Command(c.CommandArgs[0], c.CommandArgs[1:]...)
+		if cred.switches() {
+			cmd.SysProcAttr = cred.sysProcAttr()
+		}
+		return cmd, nil, nil
+	}
+	if cred.switches() {
+		spec.Credential = cred
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// resolve the command path in the same way as exec.Command
+	path := c.CommandArgs[0]
+	if filepath.Base(path) == path {
+		lp, err := exec.LookPath(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		path = lp
+	}
+
+	args := append([]string{"--exec-shim", string(b), "--", path}, c.CommandArgs...)
+	cmd := exec.Command(self, args...)
+
+	errReader, errWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.ExtraFiles = []*os.File{errWriter}
+
+	return cmd, errReader, nil
+}
+
+// waitExecShim waits for the exec shim to exec the command, and returns an error that the shim reported.
+func waitExecShim(cmd *exec.Cmd, errReader *os.File) error {
+	if errReader == nil {
+		return nil
+	}
+	defer errReader.Close()
+
+	// close the write end in this process, so that reading returns EOF when the shim has exec'ed the command.
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+
+	b, err := ioutil.ReadAll(errReader)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		return errors.New(string(b))
+	}
+	return nil
+}
+
+// RunExecShim applies the process attributes and replaces the current process with the command.
+// It is used by the hidden '--exec-shim' option. args must be the command path followed by the command arguments.
+func RunExecShim(spec string, args []string) error {
+	errWriter := os.NewFile(execShimErrorFd, "exec-shim-error")
+	syscall.CloseOnExec(execShimErrorFd)
+
+	if err := runExecShim(spec, args); err != nil {
+		if errWriter != nil {
+			errWriter.Write([]byte(err.Error()))
+			errWriter.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func runExecShim(spec string, args []string) error {
+	// nice, ionice and the CPU affinity are the attributes of the calling thread on Linux, and exec keeps only
+	// the thread that calls it. the goroutine must stay on the same thread until exec.
+	runtime.LockOSThread()
+
+	if len(args) < 2 {
+		return errors.New("requires a command to execute")
+	}
+
+	s := &execSpec{}
+	if err := json.Unmarshal([]byte(spec), s); err != nil {
+		return fmt.Errorf("invalid exec spec: %v", err)
+	}
+
+	if s.Cgroup != "" {
+		// move this process into the cgroup, so that the command runs in it from the start.
+		cg := &cgroup{path: s.Cgroup}
+		if err := cg.write("cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return fmt.Errorf("failed to move the process into cgroup '%s': %v", s.Cgroup, err)
+		}
+	}
+
+	for _, r := range s.Rlimits {
+		if err := r.apply(); err != nil {
+			return err
+		}
+	}
+
+	if s.Nice != 0 {
+		if err := setNice(s.Nice); err != nil {
+			return err
+		}
+	}
+
+	if s.IOPriority != nil {
+		if err := setIOPriority(s.IOPriority); err != nil {
+			return err
+		}
+	}
+
+	if len(s.CPUAffinity) > 0 {
+		if err := setCPUAffinity(s.CPUAffinity); err != nil {
+			return err
+		}
+	}
+
+	if s.Credential != nil {
+		if err := s.Credential.apply(); err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(args[0], args[1:], os.Environ())
+}
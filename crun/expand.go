@@ -0,0 +1,107 @@
+package crun
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// placeholderPattern matches '{{.Tag}}' and '{{.Hostname}}'. The other '{{...}}' are left as they are,
+// because handler templates use them with the report.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*\.(Tag|Hostname)\s*\}\}`)
+
+// expand expands the variables in the settings that are paths, names and commands:
+// 'log_file', 'working_directory', 'mutex', 'mutexdir', the commands of the handlers, the strings of the built-in handlers
+// and the scripts of 'lua_handlers'.
+// It runs only once, because Prepare may be called again by Check.
+func (c *Config) expand() {
+	if c.expanded {
+		return
+	}
+	c.expanded = true
+
+	c.LogFile = c.expandString(c.LogFile)
+	c.WorkingDirectory = c.expandString(c.WorkingDirectory)
+	c.Mutex = c.expandString(c.Mutex)
+	c.Mutexdir = c.expandString(c.Mutexdir)
+	c.LuaPath = c.expandString(c.LuaPath)
+
+	for _, handlers := range [][]string{c.PreHandlers, c.NoticeHandlers, c.SuccessHandlers, c.FailureHandlers, c.PostHandlers, c.HeartbeatHandlers} {
+		for i, command := range handlers {
+			handlers[i] = c.expandString(command)
+		}
+	}
+	for _, h := range c.Handlers {
+		h.Command = c.expandString(h.Command)
+		h.WebhookURL = c.expandString(h.WebhookURL)
+		h.Channel = c.expandString(h.Channel)
+		h.Username = c.expandString(h.Username)
+		h.Text = c.expandString(h.Text)
+	}
+	for _, scripts := range c.LuaHandlers {
+		for i, script := range scripts {
+			scripts[i] = c.expandString(script)
+		}
+	}
+}
+
+// expandString replaces '${VAR}', '${VAR:-default}', '{{.Tag}}' and '{{.Hostname}}' in the string.
+// VAR is looked up in 'environment' of the config first, and then in the environment of crun.
+// The default is used if VAR is unset or empty. '$${' is replaced with a literal '${'.
+func (c *Config) expandString(s string) string {
+	if !strings.Contains(s, "${") && !strings.Contains(s, "{{") {
+		return s
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		j := strings.Index(s[i:], "}")
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		b.WriteString(c.expandVar(s[i+2 : i+j]))
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+
+	return placeholderPattern.ReplaceAllStringFunc(b.String(), func(m string) string {
+		if strings.Contains(m, "Tag") {
+			return c.Tag
+		}
+		hostname, _ := os.Hostname()
+		return hostname
+	})
+}
+
+// expandVar returns the value of 'VAR' or 'VAR:-default'.
+func (c *Config) expandVar(expr string) string {
+	name, def := expr, ""
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name, def = expr[:i], expr[i+2:]
+	}
+	if v, ok := c.lookupVar(name); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func (c *Config) lookupVar(name string) (string, bool) {
+	// the last one wins like the environment of the command.
+	for i := len(c.Environment) - 1; i >= 0; i-- {
+		kv := strings.SplitN(c.Environment[i], "=", 2)
+		if len(kv) == 2 && kv[0] == name {
+			return kv[1], true
+		}
+	}
+	return os.LookupEnv(name)
+}
@@ -0,0 +1,67 @@
+package crun
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandString(t *testing.T) {
+	os.Setenv("CRUN_TEST_EXPAND_ENV", "from-env")
+	os.Setenv("CRUN_TEST_EXPAND_EMPTY", "")
+	os.Unsetenv("CRUN_TEST_EXPAND_UNSET")
+	defer os.Unsetenv("CRUN_TEST_EXPAND_ENV")
+	defer os.Unsetenv("CRUN_TEST_EXPAND_EMPTY")
+
+	hostname, _ := os.Hostname()
+
+	c := newConfig()
+	c.Tag = "nightly"
+	c.Environment = []string{"CRUN_TEST_EXPAND_ENV=from-config", "DIR=/var/log", "DIR=/srv/log"}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"no variables", "no variables"},
+		{"${DIR}/backup.log", "/srv/log/backup.log"},
+		{"${CRUN_TEST_EXPAND_ENV}", "from-config"},
+		{"${CRUN_TEST_EXPAND_UNSET:-/tmp}", "/tmp"},
+		{"${CRUN_TEST_EXPAND_UNSET}", ""},
+		{"${CRUN_TEST_EXPAND_EMPTY:-fallback}", "fallback"},
+		{"${DIR:-fallback}", "/srv/log"},
+		{"a-${DIR}-b-${DIR}", "a-/srv/log-b-/srv/log"},
+		{"$${DIR}", "${DIR}"},
+		{"$${DIR} ${DIR}", "${DIR} /srv/log"},
+		{"${DIR", "${DIR"},
+		{"{{.Tag}}.log", "nightly.log"},
+		{"{{ .Tag }}@{{.Hostname}}", "nightly@" + hostname},
+		{"{{.Output}}", "{{.Output}}"},
+	}
+
+	for _, tc := range cases {
+		if got := c.expandString(tc.in); got != tc.want {
+			t.Errorf("expandString(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestExpandLookupEnv(t *testing.T) {
+	os.Setenv("CRUN_TEST_EXPAND_ENV", "from-env")
+	defer os.Unsetenv("CRUN_TEST_EXPAND_ENV")
+
+	c := newConfig()
+	if got := c.expandString("${CRUN_TEST_EXPAND_ENV}"); got != "from-env" {
+		t.Errorf("expandString = %q, want %q", got, "from-env")
+	}
+}
+
+func TestExpandOnce(t *testing.T) {
+	c := newConfig()
+	c.Environment = []string{"NAME=job"}
+	c.Mutex = "$${NAME}"
+	c.expand()
+	c.expand()
+	if c.Mutex != "${NAME}" {
+		t.Errorf("mutex = %q, want %q", c.Mutex, "${NAME}")
+	}
+}
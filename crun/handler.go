@@ -0,0 +1,236 @@
+package crun
+
+import (
+	"fmt"
+	"github.com/kballard/go-shellquote"
+	"path/filepath"
+	"time"
+)
+
+var HandlerTypes = []string{"pre", "notice", "success", "failure", "post", "heartbeat"}
+
+// Handler failure policies.
+const (
+	// HandlerFailureIgnore ignores the error of the handler.
+	HandlerFailureIgnore = "ignore"
+	// HandlerFailureWarn outputs the error of the handler to stderr.
+	HandlerFailureWarn = "warn"
+	// HandlerFailureFailJob aborts the job if the handler is a pre handler. Otherwise it is same as "warn".
+	HandlerFailureFailJob = "fail_job"
+)
+
+var HandlerFailures = []string{HandlerFailureIgnore, HandlerFailureWarn, HandlerFailureFailJob}
+
+// Handler modes.
+const (
+	// HandlerModeParallel runs the handlers of a hook type at once.
+	HandlerModeParallel = "parallel"
+	// HandlerModeSequential runs the handlers of a hook type one by one in the defined order.
+	HandlerModeSequential = "sequential"
+)
+
+var HandlerModes = []string{HandlerModeParallel, HandlerModeSequential}
+
+// handlerRetryInterval is the interval between retries of a failed handler.
+var handlerRetryInterval = 1 * time.Second
+
+// Handler is a hook handler.
+// A handler in the lists like 'pre' and 'post' is a Handler that has only the command.
+// A structured handler is defined by '[[handler]]' table that has hook types to run on and other settings.
+type Handler struct {
+	Name         string            `toml:"name"`
+	Command      string            `toml:"command"`
+	On           []string          `toml:"on"`
+	User         string            `toml:"user"`
+	Group        string            `toml:"group"`
+	Timeout      *Duration         `toml:"timeout"`
+	Retries      *int              `toml:"retries"`
+	Failure      string            `toml:"failure"`
+	StopOnError  bool              `toml:"stop_on_error"`
+	When         *HandlerCondition `toml:"when"`
+	Input        string            `toml:"input"`
+	Template     string            `toml:"template"`
+	ArgsTemplate []string          `toml:"args_template"`
+
+	// Type is the type of the built-in handler like 'slack' and 'teams'. A built-in handler does not have 'command'.
+	Type       string   `toml:"type"`
+	WebhookURL string   `toml:"webhook_url"`
+	Channel    string   `toml:"channel"`
+	Username   string   `toml:"username"`
+	Text       string   `toml:"text"`
+	Color      string   `toml:"color"`
+	Format     string   `toml:"format"`
+	Items      []string `toml:"items"`
+
+	// luaScript is true if the handler is a Lua script in 'lua_handlers' that crun runs with a fresh Lua state.
+	luaScript bool
+}
+
+func (h *Handler) validate() error {
+	if h.Type != "" {
+		if err := h.validateBuiltin(); err != nil {
+			return err
+		}
+	} else if h.Command == "" {
+		return fmt.Errorf("handler requires 'command' or 'type'")
+	}
+	label := h.label()
+	if len(h.On) == 0 {
+		return fmt.Errorf("handler %q requires 'on'", label)
+	}
+	for _, t := range h.On {
+		if !hasString(HandlerTypes, t) {
+			return fmt.Errorf("handler %q has unknown hook type '%s'", label, t)
+		}
+	}
+	if h.Timeout != nil && *h.Timeout < 0 {
+		return fmt.Errorf("handler %q has invalid timeout %s", label, *h.Timeout)
+	}
+	if h.Retries != nil && *h.Retries < 0 {
+		return fmt.Errorf("handler %q has invalid retries %d", label, *h.Retries)
+	}
+	if h.Failure != "" && !hasString(HandlerFailures, h.Failure) {
+		return fmt.Errorf("handler %q has invalid failure policy '%s'", label, h.Failure)
+	}
+	if h.When != nil {
+		if err := h.When.validate(); err != nil {
+			return fmt.Errorf("handler %q has invalid condition: %v", label, err)
+		}
+	}
+	if err := h.validateInput(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// label returns the command of the handler, or the name of the built-in handler, to identify the handler in messages.
+func (h *Handler) label() string {
+	if h.Command == "" {
+		return h.name()
+	}
+	return h.Command
+}
+
+func (h *Handler) runsOn(handlerType string) bool {
+	return hasString(h.On, handlerType)
+}
+
+// name returns the name of the handler. The default is the type of the built-in handler, or the base name of the handler command.
+func (h *Handler) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.Type != "" {
+		return h.Type
+	}
+	args, err := shellquote.Split(h.Command)
+	if err != nil || len(args) < 1 {
+		return h.Command
+	}
+	return filepath.Base(args[0])
+}
+
+// handlers returns the handlers of the hook type.
+func (c *Config) handlers(handlerType string) []*Handler {
+	var commands []string
+	switch handlerType {
+	case "pre":
+		commands = c.PreHandlers
+	case "notice":
+		commands = c.NoticeHandlers
+	case "success":
+		commands = c.SuccessHandlers
+	case "failure":
+		commands = c.FailureHandlers
+	case "post":
+		commands = c.PostHandlers
+	case "heartbeat":
+		commands = c.HeartbeatHandlers
+	}
+
+	handlers := []*Handler{}
+	for _, command := range commands {
+		handlers = append(handlers, &Handler{Command: command})
+	}
+	for _, h := range c.Handlers {
+		if h.runsOn(handlerType) {
+			handlers = append(handlers, h)
+		}
+	}
+	return append(handlers, c.luaHandlers(handlerType)...)
+}
+
+// handlerCredential returns the user and the group that the handler runs as.
+// The settings of the handler take precedence over 'handler_user' and 'handler_group', and they take precedence over the job's user and group.
+func (c *Config) handlerCredential(h *Handler) (string, string) {
+	if h.User != "" || h.Group != "" {
+		return h.User, h.Group
+	}
+	if c.HandlerUser != "" || c.HandlerGroup != "" {
+		return c.HandlerUser, c.HandlerGroup
+	}
+	return c.User, c.Group
+}
+
+// handlerTimeout returns the timeout of the handler. 0 means no timeout.
+func (c *Config) handlerTimeout(h *Handler) Duration {
+	if h.Timeout != nil {
+		return *h.Timeout
+	}
+	return c.HandlerTimeout
+}
+
+// handlerRetries returns the number of the retries when the handler fails.
+func (c *Config) handlerRetries(h *Handler) int {
+	if h.Retries != nil {
+		return *h.Retries
+	}
+	return c.HandlerRetries
+}
+
+// handlerFailure returns the failure policy of the handler.
+// By default, a failing pre handler aborts the job and failures of the other handlers are only reported.
+func (c *Config) handlerFailure(h *Handler, handlerType string) string {
+	if h.Failure != "" {
+		return h.Failure
+	}
+	if c.HandlerFailure != "" {
+		return c.HandlerFailure
+	}
+	if handlerType == "pre" {
+		return HandlerFailureFailJob
+	}
+	return HandlerFailureWarn
+}
+
+// handlerMode returns the mode to run the handlers of the hook type.
+func (c *Config) handlerMode(handlerType string) string {
+	if mode, ok := c.HandlerMode[handlerType]; ok {
+		return mode
+	}
+	return HandlerModeParallel
+}
+
+func (c *Config) validateHandlerMode() error {
+	for handlerType, mode := range c.HandlerMode {
+		if !hasString(HandlerTypes, handlerType) {
+			return fmt.Errorf("unknown hook type '%s' in handler mode", handlerType)
+		}
+		if !hasString(HandlerModes, mode) {
+			return fmt.Errorf("invalid handler mode '%s' for '%s'. must be 'parallel' or 'sequential'", mode, handlerType)
+		}
+	}
+	if c.MaxParallelHandlers < 0 {
+		return fmt.Errorf("invalid max parallel handlers %d", c.MaxParallelHandlers)
+	}
+	return nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package crun
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kballard/go-shellquote"
+	"github.com/kohkimakimoto/crun/structs"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Handler input formats.
+const (
+	// HandlerInputJSON passes the report JSON via stdin.
+	HandlerInputJSON = "json"
+	// HandlerInputEnv passes the report as environment variables like CRUN_EXIT_CODE.
+	HandlerInputEnv = "env"
+	// HandlerInputTemplate passes the rendered template via stdin.
+	HandlerInputTemplate = "template"
+)
+
+var HandlerInputs = []string{HandlerInputJSON, HandlerInputEnv, HandlerInputTemplate}
+
+// outputTailSize is the max size of the output tail that is passed as CRUN_OUTPUT_TAIL.
+const outputTailSize = 4096
+
+// handlerTemplateData is the data to render the handler templates.
+// The fields of the report are available like '{{.ExitCode}}' and '{{.Tag}}'.
+type handlerTemplateData struct {
+	*structs.Report
+	HandlerType string
+	Duration    float64
+}
+
+func (h *Handler) validateInput() error {
+	if h.Input != "" && !hasString(HandlerInputs, h.Input) {
+		return fmt.Errorf("handler %q has invalid input '%s'. must be 'json', 'env' or 'template'", h.label(), h.Input)
+	}
+	if h.Input == HandlerInputTemplate && h.Template == "" {
+		return fmt.Errorf("handler %q requires 'template' for the template input", h.label())
+	}
+	if _, err := template.New("template").Parse(h.Template); err != nil {
+		return fmt.Errorf("handler %q has invalid template: %v", h.label(), err)
+	}
+	for _, a := range h.ArgsTemplate {
+		if _, err := template.New("args_template").Parse(a); err != nil {
+			return fmt.Errorf("handler %q has invalid args_template: %v", h.label(), err)
+		}
+	}
+	return nil
+}
+
+// input returns the stdin and the additional environment variables of the handler.
+func (h *Handler) input(reportJSON []byte, handlerType string) ([]byte, []string, error) {
+	switch h.Input {
+	case HandlerInputEnv:
+		data, err := newHandlerTemplateData(reportJSON, handlerType)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, reportEnv(data), nil
+	case HandlerInputTemplate:
+		data, err := newHandlerTemplateData(reportJSON, handlerType)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := renderTemplate(h.Template, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []byte(b), nil, nil
+	}
+	return reportJSON, nil, nil
+}
+
+// args returns the arguments of the handler command, including the rendered 'args_template'.
+func (h *Handler) args(reportJSON []byte, handlerType string) ([]string, error) {
+	args, err := shellquote.Split(h.Command)
+	if err != nil || len(args) < 1 {
+		return nil, fmt.Errorf("invalid handler: %q", h.Command)
+	}
+	if len(h.ArgsTemplate) == 0 {
+		return args, nil
+	}
+
+	data, err := newHandlerTemplateData(reportJSON, handlerType)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range h.ArgsTemplate {
+		arg, err := renderTemplate(a, data)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func newHandlerTemplateData(reportJSON []byte, handlerType string) (*handlerTemplateData, error) {
+	r := &structs.Report{}
+	if err := json.Unmarshal(reportJSON, r); err != nil {
+		return nil, err
+	}
+	return &handlerTemplateData{
+		Report:      r,
+		HandlerType: handlerType,
+		Duration:    reportDuration(r).Seconds(),
+	}, nil
+}
+
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("template").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// reportEnv returns the report as environment variables.
+func reportEnv(data *handlerTemplateData) []string {
+	r := data.Report
+	env := []string{
+		"CRUN_COMMAND=" + envValue(r.Command),
+		"CRUN_TAG=" + envValue(r.Tag),
+		"CRUN_EXIT_CODE=" + strconv.Itoa(r.ExitCode),
+		"CRUN_SIGNALED=" + strconv.FormatBool(r.Signaled),
+		"CRUN_RESULT=" + envValue(r.Result),
+		"CRUN_REASON=" + envValue(r.Reason),
+		"CRUN_HOSTNAME=" + envValue(r.Hostname),
+		"CRUN_PID=" + strconv.Itoa(r.Pid),
+		"CRUN_DURATION=" + strconv.FormatFloat(data.Duration, 'f', -1, 64),
+		"CRUN_USER_TIME=" + strconv.FormatFloat(r.UserTime, 'f', -1, 64),
+		"CRUN_SYSTEM_TIME=" + strconv.FormatFloat(r.SystemTime, 'f', -1, 64),
+		"CRUN_OUTPUT_TAIL=" + envValue(tail(r.Output, outputTailSize)),
+	}
+	if r.StartAt != nil {
+		env = append(env, "CRUN_START_AT="+r.StartAt.Format(time.RFC3339))
+	}
+	if r.EndAt != nil {
+		env = append(env, "CRUN_END_AT="+r.EndAt.Format(time.RFC3339))
+	}
+	return env
+}
+
+// envValue removes NUL bytes from the value, because an environment variable can not have them and exec fails.
+func envValue(s string) string {
+	return strings.Replace(s, "\x00", "", -1)
+}
+
+// tail returns the last part of the string within the size. It is cut at a line boundary if possible.
+func tail(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	s = s[len(s)-size:]
+	if i := strings.Index(s, "\n"); i >= 0 && i < len(s)-1 {
+		s = s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+package crun
+
+import (
+	"fmt"
+	"github.com/kballard/go-shellquote"
+	"sort"
+	"strings"
+)
+
+// CommandArgs is the command of a job in the config. It is an array of the arguments, or a string that is split like a shell.
+type CommandArgs []string
+
+func (a *CommandArgs) UnmarshalTOML(v interface{}) error {
+	switch vv := v.(type) {
+	case string:
+		args, err := shellquote.Split(vv)
+		if err != nil {
+			return fmt.Errorf("invalid command '%s': %v", vv, err)
+		}
+		*a = args
+	case []interface{}:
+		args := []string{}
+		for _, e := range vv {
+			s, ok := e.(string)
+			if !ok {
+				return fmt.Errorf("invalid command argument '%v'. must be a string", e)
+			}
+			args = append(args, s)
+		}
+		*a = args
+	default:
+		return fmt.Errorf("invalid command '%v'. must be a string or an array of strings", v)
+	}
+	return nil
+}
+
+// ApplyJob overrides the config with the settings of the job that is defined by '[jobs.<name>]' table.
+// The fields that the job does not have are inherited from the top-level config.
+// If the job is defined in some config files, they are applied in the order that the files are loaded.
+func (c *Config) ApplyJob(name string) error {
+	layers, ok := c.jobLayers[name]
+	if !ok {
+		if len(c.jobLayers) == 0 {
+			return fmt.Errorf("unknown job '%s'. no jobs are defined", name)
+		}
+		return fmt.Errorf("unknown job '%s'. defined jobs: %s", name, strings.Join(c.JobNames(), ", "))
+	}
+
+	for _, layer := range layers {
+		if err := layer.metadata.PrimitiveDecode(layer.primitive, c); err != nil {
+			return fmt.Errorf("failed to load job '%s' in '%s': %v", name, layer.path, err)
+		}
+
+		prefix := "jobs." + name + "."
+		for _, key := range layer.metadata.Keys() {
+			if k := key.String(); strings.HasPrefix(k, prefix) {
+				c.SetOrigin(strings.TrimPrefix(k, prefix), fmt.Sprintf("job '%s' in %s", name, layer.path))
+			}
+		}
+	}
+
+	if c.Tag == "" {
+		c.Tag = name
+		c.SetOrigin("tag", fmt.Sprintf("job '%s'", name))
+	}
+	return nil
+}
+
+// JobNames returns the sorted names of the jobs.
+func (c *Config) JobNames() []string {
+	names := []string{}
+	for name := range c.jobLayers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,134 @@
+package crun
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Limits is a set of resource limits (setrlimit) that are applied to the command.
+// A nil field means that the limit is inherited from crun. -1 means unlimited.
+type Limits struct {
+	Nofile *int64 `toml:"nofile"`
+	Nproc  *int64 `toml:"nproc"`
+	As     *int64 `toml:"as"`
+	Cpu    *int64 `toml:"cpu"`
+	Fsize  *int64 `toml:"fsize"`
+	Core   *int64 `toml:"core"`
+}
+
+// limitResources are the resources of the limits. The constants are defined per platform, and -1 means that the platform does not support the limit.
+var limitResources = map[string]int{
+	"nofile": rlimitNofile,
+	"nproc":  rlimitNproc,
+	"as":     rlimitAs,
+	"cpu":    rlimitCpu,
+	"fsize":  rlimitFsize,
+	"core":   rlimitCore,
+}
+
+func (l *Limits) fields() map[string]**int64 {
+	return map[string]**int64{
+		"nofile": &l.Nofile,
+		"nproc":  &l.Nproc,
+		"as":     &l.As,
+		"cpu":    &l.Cpu,
+		"fsize":  &l.Fsize,
+		"core":   &l.Core,
+	}
+}
+
+// Set sets a limit by the 'name=value' format string. The value 'unlimited' is also accepted.
+func (l *Limits) Set(s string) error {
+	splitString := strings.SplitN(s, "=", 2)
+	if len(splitString) != 2 {
+		return fmt.Errorf("invalid limit format '%s'. must be 'NAME=VALUE'", s)
+	}
+	name, value := splitString[0], splitString[1]
+
+	f, ok := l.fields()[name]
+	if !ok {
+		return fmt.Errorf("unknown limit '%s'", name)
+	}
+
+	var v int64 = -1
+	if value != "unlimited" {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit value '%s' for '%s'", value, name)
+		}
+		v = i
+	}
+	*f = &v
+
+	return nil
+}
+
+func (l *Limits) validate() error {
+	for name, f := range l.fields() {
+		if *f == nil {
+			continue
+		}
+		if **f < -1 {
+			return fmt.Errorf("invalid limit value %d for '%s'", **f, name)
+		}
+		if limitResources[name] < 0 {
+			return fmt.Errorf("limit '%s' is not supported on this platform", name)
+		}
+	}
+	return nil
+}
+
+// rlimits returns the limits to apply, in a stable order.
+func (l *Limits) rlimits() []rlimit {
+	ret := []rlimit{}
+	for name, f := range l.fields() {
+		if *f == nil {
+			continue
+		}
+		v := uint64(**f)
+		if **f == -1 {
+			v = rlimInfinity
+		}
+		ret = append(ret, rlimit{Name: name, Resource: limitResources[name], Value: v})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+type rlimit struct {
+	Name     string `json:"name"`
+	Resource int    `json:"resource"`
+	Value    uint64 `json:"value"`
+}
+
+func (r rlimit) apply() error {
+	max := r.Value
+	if r.Resource == rlimitCpu && r.Value != rlimInfinity {
+		// the kernel sends SIGKILL instead of SIGXCPU when the hard limit is reached.
+		max = r.Value + 1
+	}
+	if err := setrlimit(r.Resource, r.Value, max); err != nil {
+		return fmt.Errorf("failed to set limit '%s': %v", r.Name, err)
+	}
+	return nil
+}
+
+// limitViolation returns a description of the limit that is violated when the command died with the signal.
+func (l *Limits) limitViolation(sig syscall.Signal) string {
+	switch sig {
+	case syscall.SIGXCPU:
+		if l.Cpu != nil {
+			return fmt.Sprintf("cpu time limit exceeded (limits.cpu = %d)", *l.Cpu)
+		}
+		return "cpu time limit exceeded"
+	case syscall.SIGXFSZ:
+		if l.Fsize != nil {
+			return fmt.Sprintf("file size limit exceeded (limits.fsize = %d)", *l.Fsize)
+		}
+		return "file size limit exceeded"
+	}
+	return ""
+}
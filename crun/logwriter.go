@@ -2,13 +2,60 @@ package crun
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// openLogFile opens the log file to append the output. If the log file does not exist,
+// it is created with 'log_file_mode' and 'log_file_owner', and the missing directories are also created like mutexdir.
+func (c *Crun) openLogFile(path string) (*os.File, error) {
+	mode, err := c.Config.logFileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(path)
+	created := os.IsNotExist(err)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, mode)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return f, nil
+	}
+
+	// set the mode explicitly, because the mode of os.OpenFile is affected by umask.
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if c.Config.LogFileOwner != "" {
+		uid, gid, err := lookupOwner(c.Config.LogFileOwner)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Chown(uid, gid); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to change the owner of the log file: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
 type logWriter struct {
 	writer    io.Writer
 	c         *Crun
@@ -61,3 +108,74 @@ func (w *logWriter) prefixBytes() []byte {
 
 	return []byte(str)
 }
+
+// prefixWriter is a writer that adds the prefix to each line.
+// It writes only complete lines to the underlying writer, so that the lines of the writers
+// that share the same underlying writer are not mixed.
+type prefixWriter struct {
+	writer io.Writer
+	prefix []byte
+	buf    bytes.Buffer
+	m      *sync.Mutex
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{
+		writer: w,
+		prefix: []byte(prefix),
+		m:      &sync.Mutex{},
+	}
+}
+
+func (w *prefixWriter) Write(buf []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	var bb bytes.Buffer
+	for _, chr := range buf {
+		w.buf.WriteByte(chr)
+		if chr == '\n' {
+			bb.Write(w.prefix)
+			bb.Write(w.buf.Bytes())
+			w.buf.Reset()
+		}
+	}
+	if bb.Len() > 0 {
+		if _, err := w.writer.Write(bb.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+// Flush writes the rest that does not end with a newline.
+func (w *prefixWriter) Flush() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	w.buf.WriteByte('\n')
+	_, err := w.writer.Write(append(w.prefix, w.buf.Bytes()...))
+	w.buf.Reset()
+	return err
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent writes.
+type syncBuffer struct {
+	buf bytes.Buffer
+	m   sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
@@ -1,6 +1,9 @@
 package crun
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/cjoudrey/gluahttp"
 	"github.com/kohkimakimoto/gluaenv"
 	"github.com/kohkimakimoto/gluafs"
@@ -9,36 +12,120 @@ import (
 	glualibs "github.com/vadv/gopher-lua-libs"
 	"github.com/yuin/gluare"
 	"github.com/yuin/gopher-lua"
+	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 type LuaApp struct {
 	LState *lua.LState
+	// Sandbox restricts the script if it is not nil.
+	Sandbox *LuaSandbox
+	// Path is the search path of the modules that 'require' loads. It is ignored in the sandbox.
+	Path string
+	// Chunks are the code that runs before the script, like 'crun --lua -e <code>'.
+	Chunks []string
+	// Report is the path to the result JSON that is set to 'report' global and returned by 'crunlib.report'.
+	Report string
+	// HistoryFile is the file that keeps the history of the REPL.
+	HistoryFile string
 }
 
 func NewLuaApp() *LuaApp {
 	return &LuaApp{}
 }
 
+// Run runs the chunks and the script file that is the first argument.
+// If there are no chunks and no script, it starts the REPL.
 func (lapp *LuaApp) Run(args []string) error {
-	L := lua.NewState()
+	options := lua.Options{}
+	if lapp.Sandbox != nil {
+		options = lapp.Sandbox.options()
+	}
+	L := lua.NewState(options)
 	defer L.Close()
 	lapp.LState = L
 
 	openLibs(L)
 
+	if lapp.Sandbox != nil {
+		lapp.Sandbox.apply(L)
+	} else {
+		setLuaPath(L, lapp.Path)
+	}
+
+	if lapp.Report != "" {
+		if err := lapp.loadReport(L); err != nil {
+			return err
+		}
+	}
+
 	argtb := L.NewTable()
 	for i, v := range args {
 		L.RawSet(argtb, lua.LNumber(i), lua.LString(v))
 	}
 	L.SetGlobal("arg", argtb)
 
-	if len(args) > 0 {
-		if err := L.DoFile(args[0]); err != nil {
-			return err
+	if len(args) == 0 && len(lapp.Chunks) == 0 {
+		return lapp.repl(L)
+	}
+
+	return lapp.eval(context.Background(), L, func() error {
+		for _, chunk := range lapp.Chunks {
+			fn, err := L.Load(strings.NewReader(chunk), "(command line)")
+			if err != nil {
+				return err
+			}
+			L.Push(fn)
+			if err := L.PCall(0, lua.MultRet, nil); err != nil {
+				return err
+			}
+		}
+		if len(args) > 0 {
+			return L.DoFile(args[0])
 		}
+		return nil
+	})
+}
+
+// eval calls the function with the context. In the sandbox, the script is stopped when the timeout elapses
+// or it runs over the instruction limit.
+func (lapp *LuaApp) eval(ctx context.Context, L *lua.LState, fn func() error) error {
+	if lapp.Sandbox != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = lapp.Sandbox.context(ctx)
+		defer cancel()
+		ctx = lapp.Sandbox.limitInstructions(ctx)
+	}
+	if ctx.Done() != nil {
+		L.SetContext(ctx)
+		defer L.RemoveContext()
 	}
 
+	if err := fn(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("the script took time over %s", lapp.Sandbox.Timeout)
+		}
+		if ctx.Err() == errLuaInstructionLimit {
+			return fmt.Errorf("the script ran over %d instructions", lapp.Sandbox.InstructionLimit)
+		}
+		return err
+	}
+	return nil
+}
+
+// loadReport sets the result JSON in the file to 'report' global and 'crunlib.report', to try handlers with a sample result.
+func (lapp *LuaApp) loadReport(L *lua.LState) error {
+	b, err := ioutil.ReadFile(lapp.Report)
+	if err != nil {
+		return err
+	}
+	var report interface{}
+	if err := json.Unmarshal(b, &report); err != nil {
+		return fmt.Errorf("failed to decode the report %s: %v", lapp.Report, err)
+	}
+	L.SetGlobal("report", toLValue(L, report))
+	preloadCrunlibReport(L, report)
 	return nil
 }
 
@@ -51,5 +138,5 @@ func openLibs(L *lua.LState) {
 	L.PreloadModule("re", gluare.Loader)
 	L.PreloadModule("sh", gluash.Loader)
 	L.PreloadModule("httpclient", gluahttp.NewHttpModule(&http.Client{}).Loader)
-
+	L.PreloadModule("crunlib", crunlibLoader)
 }
@@ -0,0 +1,345 @@
+package crun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// DefaultLuaHandlerTimeout is the timeout of a Lua handler if 'handler_timeout' is not set.
+	DefaultLuaHandlerTimeout = Duration(60 * time.Second)
+	// DefaultLuaHandlerMemoryMax is the default of 'lua_handler_memory_max'.
+	DefaultLuaHandlerMemoryMax = "256M"
+)
+
+// The limits of the Lua state of a Lua handler. They bound the memory of the call stack and the data stack (registry).
+var (
+	luaHandlerCallStackSize   = 200
+	luaHandlerRegistryMaxSize = 1024 * 256
+)
+
+// errLuaHandlerFailed is raised by 'crun.fail()'.
+var errLuaHandlerFailed = errors.New("lua handler failed")
+
+// luaHandlers returns the Lua handlers of the hook type.
+func (c *Config) luaHandlers(handlerType string) []*Handler {
+	handlers := []*Handler{}
+	for _, script := range c.LuaHandlers[handlerType] {
+		handlers = append(handlers, &Handler{Command: script, luaScript: true})
+	}
+	return handlers
+}
+
+func (c *Config) validateLuaHandlers() error {
+	for handlerType := range c.LuaHandlers {
+		if !hasString(HandlerTypes, handlerType) {
+			return fmt.Errorf("unknown hook type '%s' in lua_handlers", handlerType)
+		}
+	}
+	if _, err := c.luaHandlerMemoryMax(); err != nil {
+		return err
+	}
+	return c.LuaSandbox.validate()
+}
+
+// luaHandlerMemoryMax returns 'lua_handler_memory_max' in bytes. 0 means no limit.
+func (c *Config) luaHandlerMemoryMax() (uint64, error) {
+	size, err := parseByteSize(c.LuaHandlerMemoryMax)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lua_handler_memory_max '%s'. must be a size like '256M'", c.LuaHandlerMemoryMax)
+	}
+	return size, nil
+}
+
+// parseByteSize parses a size like '512', '64K', '64M' and '1G'. An empty string is 0.
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	unit := uint64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		unit = 1 << 10
+	case 'M', 'm':
+		unit = 1 << 20
+	case 'G', 'g':
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * unit, nil
+}
+
+// luaHandlerInput is the input of the child crun process that runs a Lua handler.
+type luaHandlerInput struct {
+	Script    string          `json:"script"`
+	Report    json.RawMessage `json:"report"`
+	HookType  string          `json:"hookType"`
+	Config    interface{}     `json:"config"`
+	LuaPath   string          `json:"luaPath,omitempty"`
+	Sandbox   *LuaSandbox     `json:"sandbox,omitempty"`
+	Timeout   Duration        `json:"timeout"`
+	MemoryMax uint64          `json:"memoryMax,omitempty"`
+}
+
+// execLuaScriptHandler runs the Lua handler script with a fresh Lua state. The script runs in a child crun process
+// ('--lua-handler' option), so that the memory of the process can be limited and a crash of the script does not stop crun.
+func (c *Crun) execLuaScriptHandler(h *Handler, reportJSON []byte, handlerType string, hr *structs.HandlerReport) error {
+	timeout := c.Config.handlerTimeout(h)
+	if timeout <= 0 {
+		timeout = DefaultLuaHandlerTimeout
+	}
+	if sandbox := c.Config.LuaSandbox; sandbox.Enabled && sandbox.Timeout > 0 && sandbox.Timeout < timeout {
+		timeout = sandbox.Timeout
+	}
+	memoryMax, err := c.Config.luaHandlerMemoryMax()
+	if err != nil {
+		return err
+	}
+
+	in := &luaHandlerInput{
+		Script:    h.Command,
+		Report:    reportJSON,
+		HookType:  handlerType,
+		Config:    configToValue(reflect.ValueOf(c.Config).Elem()),
+		LuaPath:   c.Config.LuaPath,
+		Timeout:   timeout,
+		MemoryMax: memoryMax,
+	}
+	if c.Config.LuaSandbox.Enabled {
+		in.Sandbox = &c.Config.LuaSandbox
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.handlerContext(handlerType), timeout.Duration())
+	defer cancel()
+
+	stdout := newPrefixWriter(c.StdoutWriter, "["+h.name()+"] ")
+	defer stdout.Flush()
+
+	output := &syncBuffer{}
+	defer func() {
+		hr.Output = output.String()
+	}()
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(self, "--lua-handler")
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = io.MultiWriter(stdout, output)
+	cmd.Stderr = stderr
+	// the script can start processes with 'sh' module, and the timeout kills them with the script.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if cmd.ProcessState != nil {
+		hr.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("it took time over %s", timeout)
+	}
+	if err != nil {
+		return luaHandlerError(stderr.String(), c.Config.LuaHandlerMemoryMax, err)
+	}
+	return nil
+}
+
+// luaHandlerError returns the error of the child process from its stderr.
+// The Go runtime crashes when the memory limit is exceeded, and its long trace is replaced with a short message.
+func luaHandlerError(stderr, memoryMax string, err error) error {
+	msg := strings.TrimSpace(stderr)
+	if msg == "" {
+		return err
+	}
+	if strings.Contains(msg, "fatal error:") {
+		if strings.Contains(msg, "out of memory") || strings.Contains(msg, "cannot allocate memory") {
+			return fmt.Errorf("it ran over the memory limit %s", memoryMax)
+		}
+		return errors.New(strings.SplitN(msg, "\n", 2)[0])
+	}
+	return errors.New(msg)
+}
+
+// RunLuaHandler runs the Lua handler of the input from the parent crun process.
+// It is used by the hidden '--lua-handler' option. The output of the script is written to out.
+func RunLuaHandler(in io.Reader, out io.Writer) error {
+	input := &luaHandlerInput{}
+	if err := json.NewDecoder(in).Decode(input); err != nil {
+		return fmt.Errorf("invalid lua handler input: %v", err)
+	}
+	if input.MemoryMax > 0 && rlimitData >= 0 {
+		if err := setrlimit(rlimitData, input.MemoryMax, input.MemoryMax); err != nil {
+			return fmt.Errorf("failed to limit the memory: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), input.Timeout.Duration())
+	defer cancel()
+	return runLuaHandlerScript(ctx, input, out)
+}
+
+// runLuaHandlerScript runs the script with 'crun' module that has the report, the hook type and the config.
+func runLuaHandlerScript(ctx context.Context, input *luaHandlerInput, out io.Writer) error {
+	var report interface{}
+	if err := json.Unmarshal(input.Report, &report); err != nil {
+		return err
+	}
+
+	options := lua.Options{
+		CallStackSize:   luaHandlerCallStackSize,
+		RegistryMaxSize: luaHandlerRegistryMaxSize,
+	}
+	sandbox := input.Sandbox
+	if sandbox != nil {
+		options = sandbox.options()
+	}
+	L := lua.NewState(options)
+	defer L.Close()
+	if sandbox != nil {
+		ctx = sandbox.limitInstructions(ctx)
+	}
+	L.SetContext(ctx)
+
+	openLibs(L)
+	if sandbox != nil {
+		sandbox.apply(L)
+	} else {
+		setLuaPath(L, input.LuaPath)
+	}
+	preloadCrunlibReport(L, report)
+	// 'os.exit' would skip the error report of the handler.
+	disableLuaExit(L, "os.exit is not allowed in Lua handlers. use crun.fail() instead")
+
+	failure := ""
+	write := func(L *lua.LState) int {
+		values := []string{}
+		for i := 1; i <= L.GetTop(); i++ {
+			values = append(values, L.ToStringMeta(L.Get(i)).String())
+		}
+		fmt.Fprintln(out, strings.Join(values, "\t"))
+		return 0
+	}
+	L.SetGlobal("print", L.NewFunction(write))
+	L.PreloadModule("crun", func(L *lua.LState) int {
+		mod := L.NewTable()
+		mod.RawSetString("report", toLValue(L, report))
+		mod.RawSetString("hook_type", lua.LString(input.HookType))
+		mod.RawSetString("config", toLValue(L, input.Config))
+		mod.RawSetString("log", L.NewFunction(write))
+		mod.RawSetString("fail", L.NewFunction(func(L *lua.LState) int {
+			failure = L.OptString(1, errLuaHandlerFailed.Error())
+			L.RaiseError("%s", failure)
+			return 0
+		}))
+		L.Push(mod)
+		return 1
+	})
+
+	if err := L.DoFile(input.Script); err != nil {
+		if failure != "" {
+			return errors.New(failure)
+		}
+		if ctx.Err() == errLuaInstructionLimit {
+			return fmt.Errorf("it ran over %d instructions", sandbox.InstructionLimit)
+		}
+		return err
+	}
+	return nil
+}
+
+// disableLuaExit replaces 'os.exit' with the function that raises the error, if the state has it.
+func disableLuaExit(L *lua.LState, msg string) {
+	osLib, ok := L.GetGlobal("os").(*lua.LTable)
+	if !ok || osLib.RawGetString("exit") == lua.LNil {
+		return
+	}
+	osLib.RawSetString("exit", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("%s", msg)
+		return 0
+	}))
+}
+
+// configToValue converts the config to a value that has the config keys, which can be encoded to JSON.
+// Durations are seconds, and the jobs are not included.
+func configToValue(v reflect.Value) interface{} {
+	if d, ok := v.Interface().(Duration); ok {
+		return d.Duration().Seconds()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configToValue(v.Elem())
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Slice:
+		values := []interface{}{}
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, configToValue(v.Index(i)))
+		}
+		return values
+	case reflect.Map:
+		values := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			values[k.String()] = configToValue(v.MapIndex(k))
+		}
+		return values
+	case reflect.Struct:
+		values := map[string]interface{}{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("toml")
+			if f.PkgPath != "" || tag == "" || tag == "-" || tag == "jobs" {
+				continue
+			}
+			values[tag] = configToValue(v.Field(i))
+		}
+		return values
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
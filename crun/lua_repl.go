@@ -0,0 +1,370 @@
+package crun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// luaREPLHistorySize is the number of the lines that the history of the REPL keeps.
+const luaREPLHistorySize = 1000
+
+// errInterrupted is returned when the input is canceled by Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// repl reads Lua code from stdin and evaluates it until EOF.
+// An expression prints its values, and an incomplete statement continues on the next lines.
+func (lapp *LuaApp) repl(L *lua.LState) error {
+	r := newLineReader(os.Stdin, os.Stdout, lapp.HistoryFile)
+	if r.terminal {
+		fmt.Printf("%s %s Lua REPL. Press Ctrl-D to exit.\n", DisplayName, Version)
+	}
+
+	for {
+		fn, err := readLuaChunk(L, r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == errInterrupted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fn == nil {
+			continue
+		}
+		if err := lapp.replEval(L, fn); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// readLuaChunk reads the lines until they are a complete chunk, and compiles it.
+// It returns nil if the line is blank or the chunk has a syntax error.
+func readLuaChunk(L *lua.LState, r *lineReader) (*lua.LFunction, error) {
+	line, err := r.readLine("> ")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+	// evaluate the line as an expression first to print the values.
+	if fn, err := L.Load(strings.NewReader("return "+line), "stdin"); err == nil {
+		return fn, nil
+	}
+
+	code := line
+	for {
+		fn, err := L.Load(strings.NewReader(code), "stdin")
+		if err == nil {
+			return fn, nil
+		}
+		if !incompleteLuaChunk(err) {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil
+		}
+		line, err := r.readLine(">> ")
+		if err != nil {
+			return nil, err
+		}
+		code += "\n" + line
+	}
+}
+
+// incompleteLuaChunk reports whether the syntax error is caused by the end of the code, so more lines can complete it.
+func incompleteLuaChunk(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "at EOF") && !strings.Contains(msg, "unterminated string")
+}
+
+// replEval calls the compiled chunk and prints the values that it returns. Ctrl-C interrupts the chunk.
+func (lapp *LuaApp) replEval(L *lua.LState, fn *lua.LFunction) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	top := L.GetTop()
+	err := lapp.eval(ctx, L, func() error {
+		L.Push(fn)
+		return L.PCall(0, lua.MultRet, nil)
+	})
+	if err != nil {
+		L.SetTop(top)
+		if ctx.Err() == context.Canceled {
+			return errInterrupted
+		}
+		return err
+	}
+
+	values := []string{}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		values = append(values, L.ToStringMeta(L.Get(i)).String())
+	}
+	L.SetTop(top)
+	if len(values) > 0 {
+		fmt.Println(strings.Join(values, "\t"))
+	}
+	return nil
+}
+
+// lineReader reads lines from the input. If the input is a terminal, it edits the line and keeps the history.
+type lineReader struct {
+	in          *bufio.Reader
+	out         io.Writer
+	fd          int
+	terminal    bool
+	history     []string
+	historyFile string
+}
+
+func newLineReader(in *os.File, out io.Writer, historyFile string) *lineReader {
+	r := &lineReader{
+		in:          bufio.NewReader(in),
+		out:         out,
+		fd:          int(in.Fd()),
+		history:     []string{},
+		historyFile: historyFile,
+	}
+	if _, err := getTermios(r.fd); err == nil {
+		r.terminal = true
+		r.loadHistory()
+	}
+	return r
+}
+
+// readLine reads a line. It returns io.EOF at the end of the input or by Ctrl-D, and errInterrupted by Ctrl-C.
+func (r *lineReader) readLine(prompt string) (string, error) {
+	if !r.terminal {
+		line, err := r.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	orig, err := getTermios(r.fd)
+	if err != nil {
+		return "", err
+	}
+	raw := *orig
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(r.fd, &raw); err != nil {
+		return "", err
+	}
+	line, err := r.edit(prompt)
+	setTermios(r.fd, orig)
+	if err != nil {
+		return "", err
+	}
+	r.addHistory(line)
+	return line, nil
+}
+
+// edit edits a line in the raw mode of the terminal. It supports the basic Emacs-like keys and the arrow keys.
+func (r *lineReader) edit(prompt string) (string, error) {
+	buf := []rune{}
+	pos := 0
+	// the last entry is the line that is being edited.
+	history := append(append([]string{}, r.history...), "")
+	hpos := len(history) - 1
+
+	refresh := func() {
+		fmt.Fprintf(r.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Fprintf(r.out, "\x1b[%dD", n)
+		}
+	}
+	moveHistory := func(d int) {
+		if hpos+d < 0 || hpos+d >= len(history) {
+			return
+		}
+		history[hpos] = string(buf)
+		hpos += d
+		buf = []rune(history[hpos])
+		pos = len(buf)
+	}
+	insert := func(c rune) {
+		buf = append(buf[:pos], append([]rune{c}, buf[pos:]...)...)
+		pos++
+	}
+
+	refresh()
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(r.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(r.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(r.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(buf) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf = buf[pos:]
+			pos = 0
+		case 12: // Ctrl-L
+			fmt.Fprint(r.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			moveHistory(-1)
+		case 14: // Ctrl-N
+			moveHistory(1)
+		case '\t':
+			insert(' ')
+			insert(' ')
+		case 27: // escape sequences of the arrow keys and so on.
+			seq := r.readEscapeSequence()
+			switch seq {
+			case "[A", "OA":
+				moveHistory(-1)
+			case "[B", "OB":
+				moveHistory(1)
+			case "[C", "OC":
+				if pos < len(buf) {
+					pos++
+				}
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~":
+				pos = 0
+			case "[F", "OF", "[4~":
+				pos = len(buf)
+			case "[3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if c >= 32 {
+				insert(c)
+			}
+		}
+		refresh()
+	}
+}
+
+// readEscapeSequence reads the rest of the escape sequence like '[A' and '[3~'.
+func (r *lineReader) readEscapeSequence() string {
+	c, _, err := r.in.ReadRune()
+	if err != nil || (c != '[' && c != 'O') {
+		return ""
+	}
+	seq := []rune{c}
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c < '0' || c > '9' {
+			return string(seq)
+		}
+	}
+}
+
+func (r *lineReader) loadHistory() {
+	if r.historyFile == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(r.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			r.history = append(r.history, line)
+		}
+	}
+	if len(r.history) > luaREPLHistorySize {
+		r.history = r.history[len(r.history)-luaREPLHistorySize:]
+		ioutil.WriteFile(r.historyFile, []byte(strings.Join(r.history, "\n")+"\n"), 0600)
+	}
+}
+
+// addHistory adds the line to the history, and appends it to the history file.
+func (r *lineReader) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(r.history) > 0 && r.history[len(r.history)-1] == line) {
+		return
+	}
+	r.history = append(r.history, line)
+	if len(r.history) > luaREPLHistorySize {
+		r.history = r.history[1:]
+	}
+	if r.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(r.historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+func getTermios(fd int) (*syscall.Termios, error) {
+	t := &syscall.Termios{}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlGetTermios, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return nil, errno
+	}
+	return t, nil
+}
+
+func setTermios(fd int, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctlSetTermios, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
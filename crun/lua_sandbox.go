@@ -0,0 +1,295 @@
+package crun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The defaults of the Lua sandbox.
+var (
+	DefaultLuaSandboxModules          = []string{"json", "re", "regexp", "strings", "time", "yaml", "inspect", "humanize", "template"}
+	DefaultLuaSandboxTimeout          = Duration(30 * time.Second)
+	DefaultLuaSandboxInstructionLimit = int64(100000000)
+	DefaultLuaSandboxCallStackSize    = 200
+	DefaultLuaSandboxRegistryMaxSize  = 256 * 1024
+)
+
+// errLuaInstructionLimit is the error of the context when a script runs over the instruction limit.
+var errLuaInstructionLimit = errors.New("the script ran over the instruction limit")
+
+// luaSandboxDisabledFunctions are the functions of the standard libraries that are removed in the sandbox,
+// because they run processes, access files, exit crun or load code that the allowlist does not cover.
+var luaSandboxDisabledFunctions = map[string][]string{
+	"_G": {"dofile", "loadfile", "load", "loadstring"},
+	"os": {"execute", "exit", "remove", "rename", "tmpname", "setenv"},
+	"io": {"popen", "open", "lines", "input", "output"},
+}
+
+// luaSandboxDisabledModules are the standard libraries that are removed in the sandbox.
+// 'debug' can reach the registry and the upvalues of any function, so it can restore the removed functions.
+var luaSandboxDisabledModules = []string{"debug"}
+
+// luaSandboxModuleRestrictions change the allowed modules that can escape the sandbox.
+// 'template.dofile' reads any file, and 'time.sleep' does not stop at the timeout or the instruction limit.
+var luaSandboxModuleRestrictions = map[string]func(L *lua.LState, mod *lua.LTable){
+	"template": func(L *lua.LState, mod *lua.LTable) {
+		mod.RawSetString("dofile", lua.LNil)
+	},
+	"time": func(L *lua.LState, mod *lua.LTable) {
+		mod.RawSetString("sleep", L.NewFunction(luaSandboxSleep))
+	},
+}
+
+// LuaSandbox is the settings to run Lua scripts in a restricted environment.
+type LuaSandbox struct {
+	Enabled bool `toml:"enabled" json:"enabled"`
+	// Modules are the modules that the scripts can require.
+	Modules []string `toml:"modules" json:"modules"`
+	// Timeout is the time that a script can run. 0 means no limit.
+	Timeout Duration `toml:"timeout" json:"timeout"`
+	// InstructionLimit is the number of the VM instructions that a script can run. 0 means no limit.
+	InstructionLimit int64 `toml:"instruction_limit" json:"instruction_limit"`
+	CallStackSize    int   `toml:"call_stack_size" json:"call_stack_size"`
+	RegistryMaxSize  int   `toml:"registry_max_size" json:"registry_max_size"`
+}
+
+// LuaSandboxEnv is the environment variable that passes the sandbox settings to the handlers that run 'crun --lua'.
+const LuaSandboxEnv = "CRUN_LUA_SANDBOX"
+
+// LuaSandboxFromEnv returns the sandbox of the settings in LuaSandboxEnv. It returns nil if the variable is not set.
+func LuaSandboxFromEnv() (*LuaSandbox, error) {
+	v := os.Getenv(LuaSandboxEnv)
+	if v == "" {
+		return nil, nil
+	}
+	s := NewLuaSandbox()
+	if err := json.Unmarshal([]byte(v), s); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", LuaSandboxEnv, err)
+	}
+	if !s.Enabled {
+		return nil, nil
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// env returns the environment variable that has the settings.
+func (s *LuaSandbox) env() string {
+	b, _ := json.Marshal(s)
+	return LuaSandboxEnv + "=" + string(b)
+}
+
+// NewLuaSandbox returns the sandbox that has the default settings.
+func NewLuaSandbox() *LuaSandbox {
+	return &LuaSandbox{
+		Enabled:          true,
+		Modules:          append([]string{}, DefaultLuaSandboxModules...),
+		Timeout:          DefaultLuaSandboxTimeout,
+		InstructionLimit: DefaultLuaSandboxInstructionLimit,
+		CallStackSize:    DefaultLuaSandboxCallStackSize,
+		RegistryMaxSize:  DefaultLuaSandboxRegistryMaxSize,
+	}
+}
+
+func (s *LuaSandbox) validate() error {
+	if s.Timeout < 0 {
+		return fmt.Errorf("invalid lua_sandbox timeout %s", s.Timeout)
+	}
+	if s.InstructionLimit < 0 {
+		return fmt.Errorf("invalid lua_sandbox instruction_limit %d", s.InstructionLimit)
+	}
+	if s.CallStackSize <= 0 {
+		return fmt.Errorf("invalid lua_sandbox call_stack_size %d", s.CallStackSize)
+	}
+	if s.RegistryMaxSize <= 0 {
+		return fmt.Errorf("invalid lua_sandbox registry_max_size %d", s.RegistryMaxSize)
+	}
+	return nil
+}
+
+// options returns the options of a Lua state that limit the call stack and the registry.
+func (s *LuaSandbox) options() lua.Options {
+	registrySize := lua.RegistrySize
+	if registrySize > s.RegistryMaxSize {
+		registrySize = s.RegistryMaxSize
+	}
+	return lua.Options{
+		CallStackSize:   s.CallStackSize,
+		RegistrySize:    registrySize,
+		RegistryMaxSize: s.RegistryMaxSize,
+	}
+}
+
+// context returns the context that is canceled when the timeout of the sandbox elapses.
+func (s *LuaSandbox) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, s.Timeout.Duration())
+}
+
+// limitInstructions returns the context that is done when a Lua state that has it runs over the instruction limit.
+func (s *LuaSandbox) limitInstructions(parent context.Context) context.Context {
+	if s.InstructionLimit <= 0 {
+		return parent
+	}
+	return &luaInstructionContext{Context: parent, limit: s.InstructionLimit}
+}
+
+// luaInstructionContext counts the instructions of Lua states. The VM of gopher-lua has no hook to count them,
+// but it calls Done of the context once before each instruction, so the calls of Done are counted.
+type luaInstructionContext struct {
+	context.Context
+	limit int64
+	count int64
+}
+
+// luaClosedChannel is returned by Done after the limit is exceeded.
+var luaClosedChannel = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+func (c *luaInstructionContext) Done() <-chan struct{} {
+	if atomic.AddInt64(&c.count, 1) > c.limit {
+		return luaClosedChannel
+	}
+	return c.Context.Done()
+}
+
+func (c *luaInstructionContext) Err() error {
+	if atomic.LoadInt64(&c.count) > c.limit {
+		return errLuaInstructionLimit
+	}
+	return c.Context.Err()
+}
+
+// apply restricts the Lua state. It must be called after the modules are preloaded.
+// The modules that are not in the allowlist are removed, and 'require' can not load modules from files.
+func (s *LuaSandbox) apply(L *lua.LState) {
+	for name, functions := range luaSandboxDisabledFunctions {
+		tb, ok := L.GetGlobal(name).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		for _, fn := range functions {
+			tb.RawSetString(fn, lua.LNil)
+		}
+	}
+	for _, name := range luaSandboxDisabledModules {
+		L.SetGlobal(name, lua.LNil)
+		if loaded, ok := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+			loaded.RawSetString(name, lua.LNil)
+		}
+	}
+	shareCoroutineContext(L)
+
+	pkg, ok := L.GetGlobal("package").(*lua.LTable)
+	if !ok {
+		return
+	}
+	if preload, ok := pkg.RawGetString("preload").(*lua.LTable); ok {
+		names := []string{}
+		preload.ForEach(func(k, _ lua.LValue) {
+			names = append(names, k.String())
+		})
+		for _, name := range names {
+			if !hasString(s.Modules, name) {
+				preload.RawSetString(name, lua.LNil)
+			}
+		}
+		for name, restrict := range luaSandboxModuleRestrictions {
+			restrictPreloadedModule(L, preload, name, restrict)
+		}
+	}
+	if loaders, ok := pkg.RawGetString("loaders").(*lua.LTable); ok {
+		// keep only the first loader that loads the preloaded modules. 'require' refers to this table.
+		for i := loaders.Len(); i > 1; i-- {
+			loaders.Remove(i)
+		}
+	}
+	pkg.RawSetString("path", lua.LString(""))
+}
+
+// shareCoroutineContext makes the coroutines run with the context of the state that creates them.
+// gopher-lua gives a coroutine a child context, and the instructions in it would not be counted.
+func shareCoroutineContext(L *lua.LState) {
+	co, ok := L.GetGlobal("coroutine").(*lua.LTable)
+	if !ok {
+		return
+	}
+	wrap := func(name string, thread func(lua.LValue) *lua.LState) {
+		orig, ok := co.RawGetString(name).(*lua.LFunction)
+		if !ok {
+			return
+		}
+		co.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			n := L.GetTop()
+			L.Push(orig)
+			for i := 1; i <= n; i++ {
+				L.Push(L.Get(i))
+			}
+			L.Call(n, 1)
+			if th := thread(L.Get(-1)); th != nil && L.Context() != nil {
+				th.SetContext(L.Context())
+			}
+			return 1
+		}))
+	}
+	wrap("create", func(v lua.LValue) *lua.LState {
+		th, _ := v.(*lua.LState)
+		return th
+	})
+	wrap("wrap", func(v lua.LValue) *lua.LState {
+		// the function of 'coroutine.wrap' has the coroutine in the first upvalue.
+		if fn, ok := v.(*lua.LFunction); ok && len(fn.Upvalues) > 0 {
+			th, _ := fn.Upvalues[0].Value().(*lua.LState)
+			return th
+		}
+		return nil
+	})
+}
+
+// restrictPreloadedModule wraps the loader of the preloaded module to change the module after it is loaded.
+func restrictPreloadedModule(L *lua.LState, preload *lua.LTable, name string, restrict func(*lua.LState, *lua.LTable)) {
+	loader, ok := preload.RawGetString(name).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	preload.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+		L.Push(loader)
+		L.Push(L.Get(1))
+		L.Call(1, 1)
+		if mod, ok := L.Get(-1).(*lua.LTable); ok {
+			restrict(L, mod)
+		}
+		return 1
+	}))
+}
+
+// luaSandboxSleep is 'time.sleep' that wakes up when the context of the Lua state is done.
+func luaSandboxSleep(L *lua.LState) int {
+	d := time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+	ctx := L.Context()
+	if ctx == nil {
+		time.Sleep(d)
+		return 0
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		L.RaiseError("%s", ctx.Err().Error())
+	case <-t.C:
+	}
+	return 0
+}
@@ -0,0 +1,278 @@
+package crun
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics push types.
+const (
+	MetricsTypePushgateway = "pushgateway"
+	MetricsTypeStatsd      = "statsd"
+)
+
+var MetricsTypes = []string{MetricsTypePushgateway, MetricsTypeStatsd}
+
+var (
+	DefaultMetricsPrefix  = "crun"
+	DefaultMetricsTimeout = Duration(10 * time.Second)
+)
+
+// MetricsConfig is the settings to push the metrics of the job at the end of the job.
+type MetricsConfig struct {
+	// Type is 'pushgateway' or 'statsd'.
+	Type string `toml:"type"`
+	// Address is the URL of the Pushgateway like 'http://localhost:9091', or the 'host:port' of the StatsD server.
+	Address string `toml:"address"`
+	// Job is the name to group the metrics. The default is the tag, or the mutex id if the tag is empty.
+	Job string `toml:"job"`
+	// Prefix is the prefix of the StatsD metric names.
+	Prefix string `toml:"prefix"`
+	// Timeout is the timeout to push the metrics.
+	Timeout Duration `toml:"timeout"`
+}
+
+// Enabled reports whether the metrics should be pushed.
+func (m *MetricsConfig) Enabled() bool {
+	return m.Type != ""
+}
+
+func (m *MetricsConfig) validate() error {
+	if m.Type == "" {
+		return nil
+	}
+	if !hasString(MetricsTypes, m.Type) {
+		return fmt.Errorf("invalid metrics type '%s'. must be 'pushgateway' or 'statsd'", m.Type)
+	}
+	if m.Address == "" {
+		return fmt.Errorf("metrics type '%s' requires 'address'", m.Type)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("invalid metrics timeout %s", m.Timeout)
+	}
+	return nil
+}
+
+// exportMetrics exports the metrics of the finished job.
+func (c *Crun) exportMetrics(r *structs.Report, success bool) {
+	c.writeMetricsTextfile(r, success)
+	c.pushMetrics(r, success)
+}
+
+// pushMetrics pushes the metrics of the job to the Pushgateway or the StatsD server of 'metrics.type'.
+// The job name is 'metrics.job', the tag or the mutex id, in that order.
+func (c *Crun) pushMetrics(r *structs.Report, success bool) {
+	m := &c.Config.Metrics
+	if !m.Enabled() {
+		return
+	}
+
+	job := m.Job
+	if job == "" {
+		job = r.Tag
+	}
+	if job == "" {
+		job = c.mutexID()
+	}
+	timeout := m.Timeout.Duration()
+
+	var err error
+	switch m.Type {
+	case MetricsTypePushgateway:
+		err = pushToPushgateway(m.Address, job, r, success, timeout)
+	case MetricsTypeStatsd:
+		err = pushToStatsd(m.Address, m.Prefix, job, r, success, timeout)
+	}
+	if err != nil {
+		c.handleError(fmt.Errorf("failed to push metrics to %s '%s': %v", m.Type, m.Address, err))
+	}
+}
+
+// pushToPushgateway pushes the metrics to the group of the job and the host.
+// It uses POST, so the metrics that are not pushed this time (like 'crun_last_success_timestamp_seconds' on failure) are kept in the group.
+func pushToPushgateway(address, job string, r *structs.Report, success bool, timeout time.Duration) error {
+	path := "/metrics" + pushgatewayGroupingKey("job", job) + pushgatewayGroupingKey("instance", r.Hostname)
+	if r.Tag != "" {
+		path += pushgatewayGroupingKey("tag", r.Tag)
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	address = strings.TrimRight(address, "/")
+
+	labels := map[string]string{"job": job, "instance": r.Hostname}
+	if r.Tag != "" {
+		labels["tag"] = r.Tag
+	}
+	// the counters are best-effort. if they can not be read, only the gauges are pushed.
+	counters, countersErr := pushgatewayCounters(client, address, labels, []string{"crun_job_success_total", "crun_job_failure_total"})
+	if countersErr == nil {
+		if success {
+			counters["crun_job_success_total"]++
+		} else {
+			counters["crun_job_failure_total"]++
+		}
+	}
+
+	var b bytes.Buffer
+	metric := func(name, typ, help string, v float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+		fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	gauge := func(name, help string, v float64) {
+		metric(name, "gauge", help, v)
+	}
+	if countersErr == nil {
+		metric("crun_job_success_total", "counter", "The number of the successful runs.", counters["crun_job_success_total"])
+		metric("crun_job_failure_total", "counter", "The number of the failed runs.", counters["crun_job_failure_total"])
+	}
+	gauge("crun_last_exit_code", "The exit code of the last run.", float64(r.ExitCode))
+	if success {
+		gauge("crun_last_success", "Whether the last run succeeded.", 1)
+	} else {
+		gauge("crun_last_success", "Whether the last run succeeded.", 0)
+	}
+	if r.StartAt != nil {
+		gauge("crun_last_start_timestamp_seconds", "The time that the last run started at in unix seconds.", unixSeconds(*r.StartAt))
+		gauge("crun_last_duration_seconds", "The time that the last run took in seconds.", reportDuration(r).Seconds())
+		gauge("crun_last_user_time_seconds", "The user CPU time of the last run in seconds.", r.UserTime)
+		gauge("crun_last_system_time_seconds", "The system CPU time of the last run in seconds.", r.SystemTime)
+	}
+	if r.EndAt != nil {
+		if success {
+			gauge("crun_last_success_timestamp_seconds", "The time that the last successful run finished at in unix seconds.", unixSeconds(*r.EndAt))
+		} else {
+			gauge("crun_last_failure_timestamp_seconds", "The time that the last failed run finished at in unix seconds.", unixSeconds(*r.EndAt))
+		}
+	}
+
+	resp, err := client.Post(address+path, "text/plain; version=0.0.4", &b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if countersErr != nil {
+		return fmt.Errorf("pushed the metrics without the counters, because they can not be read: %v", countersErr)
+	}
+	return nil
+}
+
+// pushgatewayCounters returns the current values of the counters in the group that has the labels.
+// The Pushgateway does not accumulate the pushed values, so crun reads the values that it pushed last time and increments them.
+func pushgatewayCounters(client *http.Client, address string, labels map[string]string, names []string) (map[string]float64, error) {
+	counters := map[string]float64{}
+	for _, name := range names {
+		counters[name] = 0
+	}
+
+	resp, err := client.Get(address + "/api/v1/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body := struct {
+		Data []map[string]json.RawMessage `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	for _, group := range body.Data {
+		groupLabels := map[string]string{}
+		if err := json.Unmarshal(group["labels"], &groupLabels); err != nil || !reflect.DeepEqual(groupLabels, labels) {
+			continue
+		}
+		for _, name := range names {
+			raw, ok := group[name]
+			if !ok {
+				continue
+			}
+			family := struct {
+				Metrics []struct {
+					Value string `json:"value"`
+				} `json:"metrics"`
+			}{}
+			if err := json.Unmarshal(raw, &family); err != nil || len(family.Metrics) == 0 {
+				continue
+			}
+			if v, err := strconv.ParseFloat(family.Metrics[0].Value, 64); err == nil {
+				counters[name] = v
+			}
+		}
+	}
+	return counters, nil
+}
+
+// pushgatewayGroupingKey returns the path segments of a grouping key label.
+// A value that can not be a path segment is encoded with base64.
+func pushgatewayGroupingKey(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Sprintf("/%s@base64/%s", name, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+	return fmt.Sprintf("/%s/%s", name, url.PathEscape(value))
+}
+
+var statsdInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// pushToStatsd sends the metrics in a UDP packet.
+func pushToStatsd(address, prefix, job string, r *structs.Report, success bool, timeout time.Duration) error {
+	name := statsdInvalidChars.ReplaceAllString(job, "_") + "."
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+
+	lines := []string{
+		name + "runs:1|c",
+	}
+	if r.ExitCode < 0 {
+		// a signed gauge value changes the current value, so it must be reset to zero first.
+		lines = append(lines, name+"exit_code:0|g")
+	}
+	lines = append(lines, name+"exit_code:"+strconv.Itoa(r.ExitCode)+"|g")
+	if success {
+		lines = append(lines, name+"success_total:1|c")
+	} else {
+		lines = append(lines, name+"failure_total:1|c")
+	}
+	if r.StartAt != nil {
+		lines = append(lines,
+			name+"duration:"+strconv.FormatInt(reportDuration(r).Milliseconds(), 10)+"|ms",
+			name+"user_time:"+strconv.FormatInt(int64(r.UserTime*1000), 10)+"|ms",
+			name+"system_time:"+strconv.FormatInt(int64(r.SystemTime*1000), 10)+"|ms",
+		)
+	}
+
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
@@ -0,0 +1,120 @@
+package crun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPushgatewayCounters(t *testing.T) {
+	names := []string{"crun_job_success_total", "crun_job_failure_total"}
+	labels := map[string]string{"job": "backup", "instance": "web1"}
+
+	cases := []struct {
+		name    string
+		status  int
+		body    string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name:   "no groups",
+			status: http.StatusOK,
+			body:   `{"status":"success","data":[]}`,
+			want:   map[string]float64{"crun_job_success_total": 0, "crun_job_failure_total": 0},
+		},
+		{
+			name:   "matching group",
+			status: http.StatusOK,
+			body: `{"status":"success","data":[
+				{"labels":{"job":"backup","instance":"web1"},
+				 "crun_job_success_total":{"metrics":[{"value":"12"}]},
+				 "crun_job_failure_total":{"metrics":[{"value":"3"}]}}
+			]}`,
+			want: map[string]float64{"crun_job_success_total": 12, "crun_job_failure_total": 3},
+		},
+		{
+			name:   "other groups are ignored",
+			status: http.StatusOK,
+			body: `{"status":"success","data":[
+				{"labels":{"job":"backup","instance":"web2"},
+				 "crun_job_success_total":{"metrics":[{"value":"99"}]}},
+				{"labels":{"job":"backup","instance":"web1","tag":"nightly"},
+				 "crun_job_success_total":{"metrics":[{"value":"98"}]}},
+				{"labels":{"job":"backup","instance":"web1"},
+				 "crun_job_success_total":{"metrics":[{"value":"5"}]}}
+			]}`,
+			want: map[string]float64{"crun_job_success_total": 5, "crun_job_failure_total": 0},
+		},
+		{
+			name:   "invalid values are ignored",
+			status: http.StatusOK,
+			body: `{"status":"success","data":[
+				{"labels":{"job":"backup","instance":"web1"},
+				 "crun_job_success_total":{"metrics":[{"value":"many"}]},
+				 "crun_job_failure_total":{"metrics":[]}}
+			]}`,
+			want: map[string]float64{"crun_job_success_total": 0, "crun_job_failure_total": 0},
+		},
+		{
+			name:    "error status",
+			status:  http.StatusInternalServerError,
+			body:    `internal error`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			status:  http.StatusOK,
+			body:    `<html>`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/metrics" {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer ts.Close()
+
+			got, err := pushgatewayCounters(ts.Client(), ts.URL, labels, names)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("pushgatewayCounters = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("pushgatewayCounters = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPushgatewayGroupingKey(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"job", "backup", "/job/backup"},
+		{"tag", "daily backup", "/tag/daily%20backup"},
+		{"tag", "a/b", "/tag@base64/YS9i"},
+		{"tag", "", "/tag@base64/"},
+	}
+
+	for _, tc := range cases {
+		if got := pushgatewayGroupingKey(tc.name, tc.value); got != tc.want {
+			t.Errorf("pushgatewayGroupingKey(%q, %q) = %q, want %q", tc.name, tc.value, got, tc.want)
+		}
+	}
+}
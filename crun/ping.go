@@ -0,0 +1,111 @@
+package crun
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Default settings to ping a healthchecks-style monitor.
+var (
+	DefaultPingStartSuffix   = "/start"
+	DefaultPingSuccessSuffix = ""
+	DefaultPingFailureSuffix = "/fail"
+	DefaultPingTimeout       = Duration(10 * time.Second)
+)
+
+// pingRetryInterval is the interval between retries of a failed ping.
+var pingRetryInterval = 1 * time.Second
+
+// Ping kinds.
+const (
+	pingStart   = "start"
+	pingSuccess = "success"
+	pingFailure = "failure"
+)
+
+func (c *Config) validatePing() error {
+	if c.PingRetries < 0 {
+		return fmt.Errorf("invalid ping retries %d", c.PingRetries)
+	}
+	if c.PingTimeout < 0 {
+		return fmt.Errorf("invalid ping timeout %s", c.PingTimeout)
+	}
+	return nil
+}
+
+// pingURL returns the URL to ping for the kind.
+func (c *Config) pingURL(kind string) string {
+	switch kind {
+	case pingStart:
+		return c.PingURL + c.PingStartSuffix
+	case pingSuccess:
+		return c.PingURL + c.PingSuccessSuffix
+	}
+	return c.PingURL + c.PingFailureSuffix
+}
+
+// ping sends the ping of the kind to the monitor, and retries it up to 'ping_retries' times.
+// The success and failure pings post the tail of the output if 'ping_send_output' is set.
+func (c *Crun) ping(kind string, r *structs.Report) {
+	if c.Config.PingURL == "" {
+		return
+	}
+
+	url := c.Config.pingURL(kind)
+	var body []byte
+	if c.Config.PingSendOutput && kind != pingStart {
+		body = pingBody(r)
+	}
+
+	client := &http.Client{
+		Timeout: c.Config.PingTimeout.Duration(),
+	}
+
+	var err error
+	for i := 0; i <= c.Config.PingRetries; i++ {
+		if i > 0 {
+			time.Sleep(pingRetryInterval)
+		}
+		if err = sendPing(client, url, body); err == nil {
+			return
+		}
+	}
+	c.handleError(fmt.Errorf("failed to send %s ping to %s: %v", kind, url, err))
+}
+
+func sendPing(client *http.Client, url string, body []byte) error {
+	var resp *http.Response
+	var err error
+	if body == nil {
+		resp, err = client.Get(url)
+	} else {
+		resp, err = client.Post(url, "text/plain; charset=utf-8", bytes.NewReader(body))
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// pingBody returns the body that has the exit code, the result and the tail of the output.
+func pingBody(r *structs.Report) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "exit code: %d\n", r.ExitCode)
+	fmt.Fprintf(&b, "result: %s\n", r.Result)
+	if r.Output != "" {
+		b.WriteString("\n")
+		b.WriteString(tail(r.Output, outputTailSize))
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,24 @@
+//go:build darwin || netbsd
+// +build darwin netbsd
+
+package crun
+
+import (
+	"syscall"
+)
+
+const (
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitNproc  = 0x7
+	rlimitAs     = syscall.RLIMIT_AS
+	rlimitCpu    = syscall.RLIMIT_CPU
+	rlimitFsize  = syscall.RLIMIT_FSIZE
+	rlimitCore   = syscall.RLIMIT_CORE
+	rlimitData   = syscall.RLIMIT_DATA
+)
+
+const rlimInfinity = uint64(1<<63 - 1)
+
+func setrlimit(resource int, cur, max uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: cur, Max: max})
+}
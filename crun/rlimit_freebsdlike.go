@@ -0,0 +1,25 @@
+//go:build freebsd || dragonfly
+// +build freebsd dragonfly
+
+package crun
+
+import (
+	"syscall"
+)
+
+const (
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitNproc  = 0x7
+	rlimitAs     = syscall.RLIMIT_AS
+	rlimitCpu    = syscall.RLIMIT_CPU
+	rlimitFsize  = syscall.RLIMIT_FSIZE
+	rlimitCore   = syscall.RLIMIT_CORE
+	rlimitData   = syscall.RLIMIT_DATA
+)
+
+const rlimInfinity = uint64(1<<63 - 1)
+
+// setrlimit sets the limit. The fields of syscall.Rlimit are int64 on these platforms.
+func setrlimit(resource int, cur, max uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: int64(cur), Max: int64(max)})
+}
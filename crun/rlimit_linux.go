@@ -0,0 +1,21 @@
+package crun
+
+import (
+	"syscall"
+)
+
+const (
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitNproc  = 0x6
+	rlimitAs     = syscall.RLIMIT_AS
+	rlimitCpu    = syscall.RLIMIT_CPU
+	rlimitFsize  = syscall.RLIMIT_FSIZE
+	rlimitCore   = syscall.RLIMIT_CORE
+	rlimitData   = syscall.RLIMIT_DATA
+)
+
+const rlimInfinity = ^uint64(0)
+
+func setrlimit(resource int, cur, max uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: cur, Max: max})
+}
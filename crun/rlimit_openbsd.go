@@ -0,0 +1,22 @@
+package crun
+
+import (
+	"syscall"
+)
+
+// OpenBSD does not have RLIMIT_AS.
+const (
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitNproc  = 0x7
+	rlimitAs     = -1
+	rlimitCpu    = syscall.RLIMIT_CPU
+	rlimitFsize  = syscall.RLIMIT_FSIZE
+	rlimitCore   = syscall.RLIMIT_CORE
+	rlimitData   = syscall.RLIMIT_DATA
+)
+
+const rlimInfinity = uint64(1<<63 - 1)
+
+func setrlimit(resource int, cur, max uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: cur, Max: max})
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !netbsd && !openbsd && !freebsd && !dragonfly
+// +build !linux,!darwin,!netbsd,!openbsd,!freebsd,!dragonfly
+
+package crun
+
+import (
+	"errors"
+)
+
+// Resource limits are not supported on this platform.
+const (
+	rlimitNofile = -1
+	rlimitNproc  = -1
+	rlimitAs     = -1
+	rlimitCpu    = -1
+	rlimitFsize  = -1
+	rlimitCore   = -1
+	rlimitData   = -1
+)
+
+const rlimInfinity = ^uint64(0)
+
+func setrlimit(resource int, cur, max uint64) error {
+	return errors.New("resource limits are not supported on this platform")
+}
@@ -0,0 +1,64 @@
+package crun
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+var ioniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// ioPriority is an IO scheduling class and level like ionice.
+type ioPriority struct {
+	Class int `json:"class"`
+	Level int `json:"level"`
+}
+
+func parseIoniceClass(s string) (int, error) {
+	if class, ok := ioniceClasses[s]; ok {
+		return class, nil
+	}
+	if class, err := strconv.Atoi(s); err == nil && class >= 1 && class <= 3 {
+		return class, nil
+	}
+	return 0, fmt.Errorf("invalid ionice class '%s'. must be 'realtime', 'best-effort' or 'idle'", s)
+}
+
+func (c *Config) validateScheduling() error {
+	if c.Nice < -20 || c.Nice > 19 {
+		return fmt.Errorf("invalid nice %d. must be in the range -20-19", c.Nice)
+	}
+	if c.IoniceClass != "" {
+		if _, err := parseIoniceClass(c.IoniceClass); err != nil {
+			return err
+		}
+		if c.IoniceLevel < 0 || c.IoniceLevel > 7 {
+			return fmt.Errorf("invalid ionice level %d. must be in the range 0-7", c.IoniceLevel)
+		}
+	}
+	for _, cpu := range c.CpuAffinity {
+		if cpu < 0 || cpu >= cpuSetSize {
+			return fmt.Errorf("invalid cpu %d in cpu affinity", cpu)
+		}
+	}
+	return nil
+}
+
+func (c *Config) ioPriority() *ioPriority {
+	if c.IoniceClass == "" {
+		return nil
+	}
+	class, _ := parseIoniceClass(c.IoniceClass)
+	return &ioPriority{Class: class, Level: c.IoniceLevel}
+}
+
+func setNice(nice int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+		return fmt.Errorf("failed to set nice %d: %v", nice, err)
+	}
+	return nil
+}
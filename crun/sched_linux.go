@@ -0,0 +1,33 @@
+package crun
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cpuSetSize          = 1024
+	ioprioClassShift    = 13
+	ioprioWhoProcess    = 1
+	cpuSetWordBitLength = 64
+)
+
+func setIOPriority(p *ioPriority) error {
+	prio := p.Class<<ioprioClassShift | p.Level
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return fmt.Errorf("failed to set ionice class %d level %d: %v", p.Class, p.Level, errno)
+	}
+	return nil
+}
+
+func setCPUAffinity(cpus []int) error {
+	var set [cpuSetSize / cpuSetWordBitLength]uint64
+	for _, cpu := range cpus {
+		set[cpu/cpuSetWordBitLength] |= 1 << (uint(cpu) % cpuSetWordBitLength)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set))); errno != 0 {
+		return fmt.Errorf("failed to set cpu affinity %v: %v", cpus, errno)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package crun
+
+import (
+	"errors"
+)
+
+const cpuSetSize = 1024
+
+func setIOPriority(p *ioPriority) error {
+	return errors.New("ionice is supported only on linux")
+}
+
+func setCPUAffinity(cpus []int) error {
+	return errors.New("cpu affinity is supported only on linux")
+}
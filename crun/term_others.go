@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package crun
+
+import (
+	"syscall"
+)
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
@@ -0,0 +1,168 @@
+package crun
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsLockTimeout is the time to wait for another crun that is updating the same metrics file.
+var metricsLockTimeout = 10 * time.Second
+
+// textfileMetric is a metric that is written to the textfile for the node_exporter textfile collector.
+type textfileMetric struct {
+	name       string
+	metricType string
+	help       string
+}
+
+var textfileMetrics = []textfileMetric{
+	{"crun_last_exit_code", "gauge", "The exit code of the last run."},
+	{"crun_last_start_timestamp_seconds", "gauge", "The time that the last run started at in unix seconds."},
+	{"crun_last_duration_seconds", "gauge", "The time that the last run took in seconds."},
+	{"crun_last_success_timestamp_seconds", "gauge", "The time that the last successful run finished at in unix seconds."},
+	{"crun_runs_total", "counter", "The number of the runs."},
+	{"crun_failures_total", "counter", "The number of the failed runs."},
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsTextfile returns the path of the metrics file of the job.
+func (c *Crun) metricsTextfile() string {
+	return filepath.Join(c.Config.MetricsTextfileDir, fmt.Sprintf("crun_%s.prom", c.mutexID()))
+}
+
+// writeMetricsTextfile updates the metrics file of the job with the report.
+// The file is replaced atomically, so the collector never reads a partial file.
+func (c *Crun) writeMetricsTextfile(r *structs.Report, success bool) {
+	if c.Config.MetricsTextfileDir == "" {
+		return
+	}
+	if err := c.updateMetricsTextfile(r, success); err != nil {
+		c.handleError(fmt.Errorf("failed to write metrics to '%s': %v", c.metricsTextfile(), err))
+	}
+}
+
+func (c *Crun) updateMetricsTextfile(r *structs.Report, success bool) error {
+	// the counters are read from the current file and written to the new one,
+	// so the jobs that update the same file must be serialized.
+	lockfile, err := os.OpenFile(filepath.Join(c.Config.Mutexdir, "crun-metrics-"+c.mutexID()), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lockfile.Close()
+	if err := flock(lockfile, 0644, true, metricsLockTimeout); err != nil {
+		return err
+	}
+	defer funlock(lockfile)
+
+	path := c.metricsTextfile()
+	values, err := readMetricsTextfile(path)
+	if err != nil {
+		return err
+	}
+
+	values["crun_last_exit_code"] = float64(r.ExitCode)
+	if r.StartAt != nil {
+		values["crun_last_start_timestamp_seconds"] = unixSeconds(*r.StartAt)
+		values["crun_last_duration_seconds"] = reportDuration(r).Seconds()
+	}
+	if success && r.EndAt != nil {
+		values["crun_last_success_timestamp_seconds"] = unixSeconds(*r.EndAt)
+	}
+	values["crun_runs_total"]++
+	if success {
+		// the counter must exist even if the job has never failed.
+		values["crun_failures_total"] += 0
+	} else {
+		values["crun_failures_total"]++
+	}
+
+	labels := fmt.Sprintf(`{tag="%s",host="%s",command_hash="%s"}`,
+		labelValueReplacer.Replace(r.Tag),
+		labelValueReplacer.Replace(r.Hostname),
+		commandHash(r.Command),
+	)
+
+	var b bytes.Buffer
+	for _, m := range textfileMetrics {
+		v, ok := values[m.name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.metricType)
+		fmt.Fprintf(&b, "%s%s %s\n", m.name, labels, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+
+	return writeFileAtomically(path, b.Bytes(), 0644)
+}
+
+// readMetricsTextfile reads the values of the metrics from the file. The labels are ignored.
+func readMetricsTextfile(path string) (map[string]float64, error) {
+	values := map[string]float64{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name = line[:i]
+		}
+		fields := strings.Fields(line[strings.LastIndex(line, "}")+1:])
+		if len(fields) < 1 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil {
+			values[name] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// writeFileAtomically writes the data to a temporary file and renames it to the path,
+// so the node_exporter never reads a partially written file.
+func writeFileAtomically(path string, data []byte, mode os.FileMode) error {
+	// the temporary file must not have the '.prom' extension to be ignored by the node_exporter.
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
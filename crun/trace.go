@@ -0,0 +1,346 @@
+package crun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/crun/structs"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultTracingServiceName = "crun"
+	DefaultTracingTimeout     = Duration(10 * time.Second)
+)
+
+// TracingConfig is the settings to export the trace of the job to an OpenTelemetry collector with OTLP/HTTP.
+type TracingConfig struct {
+	// Endpoint is the base URL of the collector like 'http://localhost:4318'. The traces are sent to '<endpoint>/v1/traces'.
+	Endpoint    string            `toml:"endpoint"`
+	ServiceName string            `toml:"service_name"`
+	Headers     map[string]string `toml:"headers"`
+	Timeout     Duration          `toml:"timeout"`
+}
+
+// Enabled reports whether the trace should be exported.
+func (t *TracingConfig) Enabled() bool {
+	return t.Endpoint != ""
+}
+
+func (t *TracingConfig) validate() error {
+	if t.Timeout < 0 {
+		return fmt.Errorf("invalid tracing timeout %s", t.Timeout)
+	}
+	return nil
+}
+
+// tracesURL returns the URL to post the traces to.
+func (t *TracingConfig) tracesURL() string {
+	if strings.HasSuffix(t.Endpoint, "/v1/traces") {
+		return t.Endpoint
+	}
+	return strings.TrimRight(t.Endpoint, "/") + "/v1/traces"
+}
+
+// tracer collects the spans of a run.
+type tracer struct {
+	traceID [16]byte
+	// remoteParentID is the span id in 'TRACEPARENT' environment variable that crun was started with.
+	remoteParentID [8]byte
+
+	mutex sync.Mutex
+	spans []*span
+}
+
+type span struct {
+	tracer     *tracer
+	id         [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	err        string
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// newTracer creates a tracer. If crun runs in a trace, that is passed by 'TRACEPARENT' environment variable, the spans join the trace.
+func newTracer() *tracer {
+	t := &tracer{}
+	if traceID, parentID, ok := parseTraceparent(os.Getenv("TRACEPARENT")); ok {
+		t.traceID = traceID
+		t.remoteParentID = parentID
+	} else {
+		rand.Read(t.traceID[:])
+	}
+	return t
+}
+
+// parseTraceparent parses a W3C trace context 'traceparent' header value.
+func parseTraceparent(s string) ([16]byte, [8]byte, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// root starts the root span of the run.
+func (t *tracer) root(name string) *span {
+	if t == nil {
+		return nil
+	}
+	return t.newSpan(name, t.remoteParentID)
+}
+
+func (t *tracer) newSpan(name string, parentID [8]byte) *span {
+	s := &span{
+		tracer:   t,
+		parentID: parentID,
+		name:     name,
+		start:    time.Now(),
+	}
+	rand.Read(s.id[:])
+	return s
+}
+
+// child starts a child span. It returns nil if the span is nil, so the spans are not recorded when the tracing is disabled.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(name, s.id)
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+}
+
+// finish ends the span. If err is not nil, the status of the span is an error.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// traceparent returns the W3C trace context 'traceparent' value to propagate the span to a child process.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.tracer.traceID[:]), hex.EncodeToString(s.id[:]))
+}
+
+// startTrace starts the root span of the job if the tracing is enabled.
+func (c *Crun) startTrace() {
+	if !c.Config.Tracing.Enabled() {
+		return
+	}
+	name := c.Config.Tag
+	if name == "" {
+		name = c.Command()
+	}
+	c.rootSpan = newTracer().root(name)
+}
+
+// endTrace ends the root span with the attributes from the report, and exports the trace.
+// The root span has the error status if the job exited with a non-zero code.
+func (c *Crun) endTrace(r *structs.Report) {
+	root := c.rootSpan
+	if root == nil {
+		return
+	}
+
+	root.setAttribute("crun.command", r.Command)
+	root.setAttribute("crun.tag", r.Tag)
+	root.setAttribute("crun.mutex_id", c.mutexID())
+	root.setAttribute("crun.exit_code", r.ExitCode)
+	root.setAttribute("crun.signaled", r.Signaled)
+	root.setAttribute("crun.result", r.Result)
+	if r.Reason != "" {
+		root.setAttribute("crun.reason", r.Reason)
+	}
+	root.setAttribute("crun.user_time", r.UserTime)
+	root.setAttribute("crun.system_time", r.SystemTime)
+	root.setAttribute("host.name", r.Hostname)
+	if r.Pid != 0 {
+		root.setAttribute("process.pid", r.Pid)
+	}
+
+	var err error
+	if r.ExitCode != 0 {
+		err = fmt.Errorf("%s", r.Result)
+	}
+	root.finish(err)
+
+	if err := exportTrace(&c.Config.Tracing, root.tracer); err != nil {
+		c.handleError(fmt.Errorf("failed to export the trace to '%s': %v", c.Config.Tracing.tracesURL(), err))
+	}
+}
+
+// exportTrace sends the spans to the collector with OTLP/HTTP in JSON encoding.
+func exportTrace(config *TracingConfig, t *tracer) error {
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultTracingServiceName
+	}
+
+	t.mutex.Lock()
+	spans := []otlpSpan{}
+	for _, s := range t.spans {
+		spans = append(spans, s.otlp())
+	}
+	t.mutex.Unlock()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						newOTLPAttribute("service.name", serviceName),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{
+							"name":    Name,
+							"version": Version,
+						},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", config.tracesURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{
+		Timeout: config.Timeout.Duration(),
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of a span. See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOk     = 1
+	otlpStatusCodeError  = 2
+)
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.tracer.traceID[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusCodeOk},
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attributes {
+		o.Attributes = append(o.Attributes, newOTLPAttribute(a.key, a.value))
+	}
+	if s.err != "" {
+		o.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.err}
+	}
+	return o
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch vv := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": vv}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(vv)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(vv, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": vv}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprintf("%v", vv)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
@@ -1,8 +1,13 @@
 package crun
 
 import (
+	"fmt"
+	"os"
+	"os/exec"
 	"os/user"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
 func LookupUserStruct(id string) (*user.User, error) {
@@ -40,3 +45,182 @@ func LookupGroup(id string) (int, error) {
 
 	return strconv.Atoi(g.Gid)
 }
+
+// lookupOwner resolves the owner string like 'user', 'user:group' and ':group'.
+// -1 is returned for the id that is not specified.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+
+	splitString := strings.SplitN(owner, ":", 2)
+	if splitString[0] != "" {
+		u, err := LookupUserStruct(splitString[0])
+		if err != nil {
+			return -1, -1, err
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	if len(splitString) == 2 && splitString[1] != "" {
+		id, err := LookupGroup(splitString[1])
+		if err != nil {
+			return -1, -1, err
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
+
+// credential is a user and groups that a process runs as.
+type credential struct {
+	Uid      uint32
+	Gid      uint32
+	Groups   []uint32
+	Username string
+	Home     string
+	Shell    string
+}
+
+// lookupCredential resolves the user and the group to run a process as.
+// If the user is specified, the supplementary groups of the user are initialized from the group database.
+func lookupCredential(username, group string) (*credential, error) {
+	cred := &credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if username != "" {
+		u, err := LookupUserStruct(username)
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := strconv.Atoi(u.Uid)
+		if err != nil {
+			return nil, err
+		}
+		gid, err := strconv.Atoi(u.Gid)
+		if err != nil {
+			return nil, err
+		}
+		cred.Uid = uint32(uid)
+		cred.Gid = uint32(gid)
+		cred.Username = u.Username
+		cred.Home = u.HomeDir
+		cred.Shell = lookupShell(u.Username)
+
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get groups of user '%s': %v", u.Username, err)
+		}
+		cred.Groups = []uint32{}
+		for _, g := range gids {
+			id, err := strconv.Atoi(g)
+			if err != nil {
+				return nil, err
+			}
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+
+	if group != "" {
+		id, err := LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = uint32(id)
+	}
+
+	if os.Getuid() != 0 {
+		// crun can not switch the user without root. the process runs as the current user only if it is the requested one.
+		if cred.Uid != uint32(os.Getuid()) {
+			return nil, fmt.Errorf("can not switch to user '%s': crun is not running as root", username)
+		}
+		if cred.Gid != uint32(os.Getgid()) {
+			if group == "" {
+				group = strconv.Itoa(int(cred.Gid))
+			}
+			return nil, fmt.Errorf("can not switch to group '%s': crun is not running as root", group)
+		}
+		return &credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}, nil
+	}
+
+	return cred, nil
+}
+
+// switches reports whether the process needs to switch the credential.
+func (cred *credential) switches() bool {
+	return os.Getuid() == 0 && (cred.Uid != 0 || cred.Gid != 0 || cred.Groups != nil)
+}
+
+func (cred *credential) sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    cred.Uid,
+			Gid:    cred.Gid,
+			Groups: cred.Groups,
+		},
+	}
+}
+
+// apply switches the credential of the current process. The groups must be set before the gid and the uid,
+// because the process can not change them after it drops the privileges.
+func (cred *credential) apply() error {
+	groups := make([]int, 0, len(cred.Groups))
+	for _, g := range cred.Groups {
+		groups = append(groups, int(g))
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %v", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to set gid %d: %v", cred.Gid, err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("failed to set uid %d: %v", cred.Uid, err)
+	}
+	return nil
+}
+
+// environ returns the environment variables that are updated for the user.
+func (cred *credential) environ(env []string) []string {
+	if cred.Username == "" {
+		return env
+	}
+
+	env = setEnv(env, "HOME", cred.Home)
+	env = setEnv(env, "USER", cred.Username)
+	env = setEnv(env, "LOGNAME", cred.Username)
+	env = setEnv(env, "SHELL", cred.Shell)
+	return env
+}
+
+// lookupShell returns the login shell of the user. It uses 'getent' to look up the user database through NSS,
+// so the users in LDAP and so on are also found. It returns '/bin/sh' if the shell can not be found.
+func lookupShell(username string) string {
+	defaultShell := "/bin/sh"
+
+	out, err := exec.Command("getent", "passwd", username).Output()
+	if err != nil {
+		return defaultShell
+	}
+	// name:password:uid:gid:gecos:home:shell
+	fields := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(fields) == 7 && fields[6] != "" {
+		return fields[6]
+	}
+	return defaultShell
+}
+
+func setEnv(env []string, key, value string) []string {
+	ret := []string{}
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			ret = append(ret, e)
+		}
+	}
+	return append(ret, key+"="+value)
+}
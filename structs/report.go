@@ -33,19 +33,48 @@ import "time"
 // -----------------------------------------------------------------------
 
 type Report struct {
-	Command     string     `json:"command"`
-	CommandArgs []string   `json:"commandArgs"`
-	Tag         string     `json:"tag,omitempty"`
-	Output      string     `json:"output"`
-	Stdout      string     `json:"stdout"`
-	Stderr      string     `json:"stderr"`
-	ExitCode    int        `json:"exitCode"`
-	Signaled    bool       `json:"signaled"`
-	Result      string     `json:"result"`
-	Hostname    string     `json:"hostname"`
-	Pid         int        `json:"pid,omitempty"`
-	StartAt     *time.Time `json:"startAt,omitempty"`
-	EndAt       *time.Time `json:"endAt,omitempty"`
-	SystemTime  float64    `json:"systemTime,omitempty"`
-	UserTime    float64    `json:"userTime,omitempty"`
+	Command     string           `json:"command"`
+	CommandArgs []string         `json:"commandArgs"`
+	Tag         string           `json:"tag,omitempty"`
+	Output      string           `json:"output"`
+	Stdout      string           `json:"stdout"`
+	Stderr      string           `json:"stderr"`
+	ExitCode    int              `json:"exitCode"`
+	Signaled    bool             `json:"signaled"`
+	Result      string           `json:"result"`
+	Reason      string           `json:"reason,omitempty"`
+	Hostname    string           `json:"hostname"`
+	Pid         int              `json:"pid,omitempty"`
+	StartAt     *time.Time       `json:"startAt,omitempty"`
+	EndAt       *time.Time       `json:"endAt,omitempty"`
+	Elapsed     float64          `json:"elapsed,omitempty"`
+	SystemTime  float64          `json:"systemTime,omitempty"`
+	UserTime    float64          `json:"userTime,omitempty"`
+	Cgroup      *CgroupReport    `json:"cgroup,omitempty"`
+	Handlers    []*HandlerReport `json:"handlers,omitempty"`
+}
+
+// HandlerReport is the result of a handler.
+type HandlerReport struct {
+	Type            string  `json:"type"`
+	Name            string  `json:"name"`
+	Command         string  `json:"command"`
+	ExitCode        int     `json:"exitCode"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Output          string  `json:"output"`
+	Error           string  `json:"error,omitempty"`
+	Attempts        int     `json:"attempts"`
+	Skipped         bool    `json:"skipped,omitempty"`
+}
+
+// CgroupReport is the resource usage of the cgroup that the command ran in.
+type CgroupReport struct {
+	Path        string  `json:"path"`
+	MemoryPeak  int64   `json:"memoryPeak,omitempty"`
+	OomKill     int64   `json:"oomKill"`
+	CpuUsage    float64 `json:"cpuUsage"`
+	CpuUser     float64 `json:"cpuUser"`
+	CpuSystem   float64 `json:"cpuSystem"`
+	NrThrottled int64   `json:"nrThrottled"`
+	Throttled   float64 `json:"throttled"`
 }